@@ -1,4 +1,4 @@
 flags="-X main.version=$(cat VERSION) -X 'main.build=$(date -R)'"
 echo Building with flags $flags
 
-go build -ldflags "-X main.version=$(cat VERSION) -X 'main.build=$(date -R)'"
+go build -ldflags "-X main.version=$(cat VERSION) -X 'main.build=$(date -R)'" "$@"
@@ -3,82 +3,736 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/BurntSushi/toml"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
 )
 
 // Settings
 const (
-	defaultConfigFilename = "settings.conf"
-	defaultListenAddress  = "0.0.0.0"
-	defaultLogFilename    = "flapmyport_api.log"
-	defaultListenPort     = 8080
-	defaultDBHost         = "localhost"
-	defaultDBUser         = "root"
-	defaultDBName         = "snmpflapd"
-	defaultDBPassword     = ""
-	timeFormat            = "2006-01-02 15:04:05"
-	flapChartWidth        = 333
-	flapChartHeight       = 10
-	sqlRowsLimit          = 100000
-	ifStatusUpCaption     = "up"
-	ifStatusDownCaption   = "down"
-	actionReview          = "review"
-	actionFlapChart       = "flapchart"
-	actionFlapHistory     = "flaphistory"
-	actionCheck           = "check"
-	defaultReviewInterval = time.Hour
-	getParamIfIndex       = "ifindex"
-	getParamHost          = "host"
-	getParamStartTime     = "start"
-	getParamEndTime       = "end"
-	getParamInterval      = "interval"
-	getParamFilter        = "filter"
+	defaultConfigFilename     = "settings.conf"
+	defaultListenAddress      = "0.0.0.0"
+	defaultListenPort         = 8080
+	defaultDBDriver           = driverMySQL
+	defaultDBHost             = "localhost"
+	defaultDBUser             = "root"
+	defaultDBName             = "snmpflapd"
+	defaultDBPassword         = ""
+	defaultDBTable            = "ports"
+	defaultQueryTimeout       = 30 // seconds
+	defaultDBConnMaxIdle      = 60 // seconds
+	statusClientClosedRequest = 499
+	defaultRateBurst          = 10
+	defaultFlapThreshold      = 5
+	defaultMinTransitions     = 1
+	coverageScopeWindow       = "window" // rows the review kept
+	coverageScopeTable        = "table"
+	chartColumnStateLast      = "last"     // the last flap of a chart column sets its state
+	chartColumnStateDominant  = "dominant" // the more frequent direction among its flaps does
+	defaultRecentCount        = 50
+	defaultMaxRecentFlaps     = 1000
+	defaultDiscoveryLimit     = 1000 // entries of ?hosts and ?interfaces
+	defaultStaleCollector     = 3600 // seconds
+	defaultRecentlyActive     = 900  // seconds
+	defaultReadTimeout        = 10   // seconds
+	defaultWriteTimeout       = 60   // seconds, longer than a query may take
+	defaultIdleTimeout        = 120  // seconds
+	shutdownTimeout           = 30 * time.Second
+	defaultStreamPoll         = 5 // seconds
+	defaultMaxStreams         = 4 // per client
+	streamBatchSize           = 100
+	timeFormat                = "2006-01-02 15:04:05"
+	flapChartWidth            = 333 // unless width asks for another one
+	flapChartHeight           = 10
+	defaultMaxChartWidth      = 2000
+	defaultMaxChartHeight     = 100
+	defaultMaxBodyBytes       = 64 << 10
+	defaultQueryQueue         = 5 // seconds
+	flapChartStripGap         = 1
+	flapChartLabelHeight      = 13 // basicfont.Face7x13
+	flapChartMaxStrips        = 20 // ports on a host overview chart
+	flapChartCacheSize        = 256
+	reviewCacheSize           = 64
+	flapChartLiveWindow       = time.Minute
+	flapChartLiveMaxAge       = 30    // seconds
+	flapChartStaticMaxAge     = 86400 // seconds
+	sqlRowsLimit              = 100000
+	defaultFlapHistoryLimit   = 100 // flaps on a ?flaphistory page and on a chart
+	maxFlapHistoryLimit       = 1000
+	ifStatusUpCaption         = "up"
+	ifStatusDownCaption       = "down"
+	ifStatusUnknownCaption    = "unknown"
+	actionReview              = "review"
+	actionFlapChart           = "flapchart"
+	actionFlapCharts          = "flapcharts"
+	actionFlapHistory         = "flaphistory"
+	actionEvents              = "events"
+	actionStream              = "stream"
+	actionHosts               = "hosts"
+	actionInterfaces          = "interfaces"
+	actionRecent              = "recent"
+	actionStats               = "stats"
+	actionAliasStats          = "aliasstats"
+	actionStatus              = "status"
+	actionPortStatus          = "portstatus"
+	actionCheck               = "check"
+	defaultReviewInterval     = time.Hour
+	getParamIfIndex           = "ifindex"
+	getParamHost              = "host"
+	getParamStartTime         = "start"
+	getParamEndTime           = "end"
+	getParamInterval          = "interval"
+	getParamFilter            = "filter"
+	getParamFilterMode        = "filtermode"
+	filterModeAll             = "all"
+	filterModeAny             = "any"
+	getParamFormat            = "format"
+	getParamKey               = "key"
+	getParamAfterID           = "afterId"
+	getParamLimit             = "limit"
+	getParamOffset            = "offset"
+	getParamCount             = "count"
+	getParamIncludeSubIf      = "includesubif"
+	getParamHideBlacklisted   = "hideblacklisted"
+	getParamGroupBy           = "groupby"
+	groupByAlias              = "alias"
+	getParamBucket            = "bucket"
+	getParamTopN              = "topn"
+	getParamTopBy             = "by"
+	statsBucketHour           = "hour"
+	statsBucketDay            = "day"
+	statsTopByHost            = "host"
+	statsTopByPort            = "port"
+	maxStatsTopN              = 100
+	getParamMaxHosts          = "maxhosts"
+	getParamSource            = "source"
+	getParamIncludeSid        = "includesid"
+	getParamDeep              = "deep"
+	getParamMinTransitions    = "mintransitions"
+	getParamStatus            = "status"
+	getParamDebounceMs        = "debounceMs"
+	getParamWidth             = "width"
+	getParamHeight            = "height"
+	headerAPIKey              = "X-API-Key"
+	headerFlapChartTruncated  = "X-Flapchart-Truncated"
+	headerRequestID           = "X-Request-ID"
+	headerAPIVersion          = "X-API-Version"
+	apiVersion                = 1 // bumped when a response changes incompatibly
+	formatJSON                = "json"
+	formatNDJSON              = "ndjson"
+)
+
+// Flap chart column states
+const (
+	chartStateUnknown = iota
+	chartStateUp
+	chartStateDown
+	chartStateFlappingUp
+	chartStateFlappingDown
+	chartStateSteadyUp
+	chartStateSteadyDown
+	// Shut down by an operator, only known with DBExtendedColumns
+	chartStateAdminDown
+)
+
+var chartStateCaptions = map[int]string{
+	chartStateUnknown:      "unknown",
+	chartStateUp:           "up",
+	chartStateDown:         "down",
+	chartStateFlappingUp:   "flappingUp",
+	chartStateFlappingDown: "flappingDown",
+	chartStateSteadyUp:     "steadyUp",
+	chartStateSteadyDown:   "steadyDown",
+	chartStateAdminDown:    "adminDown",
+}
+
+// chartStateDescriptions explain the captions to readers of JSON timelines
+var chartStateDescriptions = map[string]string{
+	"unknown":      "no data, nothing tells the state of the port",
+	"up":           "came up",
+	"down":         "went down",
+	"flappingUp":   "flapped, ending up",
+	"flappingDown": "flapped, ending down",
+	"steadyUp":     "stayed up",
+	"steadyDown":   "stayed down",
+	"adminDown":    "shut down by an operator",
+}
+
+// DBTLS modes of MySQL connections
+const (
+	dbTLSDisabled      = "disabled"
+	dbTLSPreferred     = "preferred" // TLS if the server supports it, without verification
+	dbTLSRequired      = "required"  // TLS with the server certificate verified
+	mysqlTLSConfigName = "flapmyport"
+)
+
+// Supported DBDriver values
+const (
+	driverMySQL    = "mysql"
+	driverPostgres = "postgres"
+	driverSQLite   = "sqlite" // needs a build with -tags sqlite
+	sqliteMemory   = ":memory:"
+)
+
+// PortView.Status values
+const (
+	portStatusStable   = "stable"
+	portStatusUnstable = "unstable"
+	portStatusDown     = "down"
+)
+
+// Default flap chart palette
+const (
+	defaultColorUp        = "#0AB226"
+	defaultColorUpState   = "#7DD48B"
+	defaultColorDown      = "#D43939"
+	defaultColorDownState = "#EF6A6A"
+	defaultColorFlapping  = "#FF8000"
+	defaultColorUnknown   = "#C8C8C8"
+	defaultColorAdminDown = "#6A7FDB"
 )
 
 type Config struct {
-	LogFilename   string
-	ListenAddress string
-	ListenPort    int
-	DBHost        string
-	DBName        string
-	DBUser        string
-	DBPassword    string
+	LogFilename    string // appended to, stderr if empty
+	LogLevel       string // one of debug, info, warn and error
+	ListenAddress  string
+	ListenPort     int
+	ListenSocket   string // Unix socket path, replaces ListenAddress and ListenPort
+	DBDriver       string
+	DBHost         string
+	DBName         string
+	DBUser         string
+	DBPassword     string
+	DBPasswordFile string // read DBPassword from this file instead, e.g. a mounted secret
+	DBTable        string
+	DBFixture      string // JSON rows to seed a SQLite database with
+	DBTLS          string // one of dbTLS* modes, MySQL only
+	DBTLSCA        string
+	DBTLSCert      string
+	DBTLSKey       string
+	DBSSLMode      string // sslmode of PostgreSQL connections, the driver's default if empty
+	// The ports table has ifSpeed and ifAdminStatus columns
+	DBExtendedColumns bool
+	QueryTimeoutSec   int // 0 waits for queries forever
+	// HTTP server timeouts, 0 disables them
+	ReadTimeoutSec    int
+	WriteTimeoutSec   int
+	IdleTimeoutSec    int
+	DBConnMaxIdleSec  int // 0 keeps idle connections forever
+	DBKeepaliveSec    int // the database is pinged this often in the background, 0 never
+	MaxWindowHours    int // longest review window, 0 is unlimited
+	APIKeys           []string
+	BasicAuthUser     string // Basic Auth credentials accepted instead of an API key
+	BasicAuthPassword string
+	RateLimit         float64 // requests per second per client, 0 disables limiting
+	RateBurst         int
+	TrustProxy        bool     // take the last X-Forwarded-For address of TrustedProxies as is
+	TrustedProxies    []string // addresses or subnets of proxies setting X-Forwarded-For
+	AllowedOrigins    []string
+	ExcludeIfNames    []string // LIKE patterns of ifNames hidden unless a port is asked for by ifIndex
+	BlacklistFile     string   // TOML list of known flapping ports
+	FlapThreshold     int      // flaps in the window making a port unstable
+	MinTransitions    int      // status changes in the window a port needs to be reviewed
+	CoverageScope     string   // rows the coverage of a review is taken from, one of coverageScope*
+	ChartColumnState  string   // how a chart column with several flaps is colored, one of chartColumnState*
+	TimeFormat        string   // Go layout of times in responses
+	BannerText        string   // answer of the index page
+	InstanceEnv       string   // e.g. prod or staging, told by the index page in JSON
+	MaxRecentFlaps    int      // largest count of ?recent
+	MaxHosts          int      // hosts in a review unless maxhosts says otherwise, 0 is unlimited
+	DiscoveryLimit    int      // entries of ?hosts and ?interfaces unless limit says otherwise, 0 is unlimited
+	StaleCollectorSec int      // ?status reports a stale collector without flaps for longer, 0 never does
+	RecentlyActiveSec int      // a port that flapped this close to the window end is recentlyActive
+	ReviewCacheTTLSec int      // reviews are answered from a cache for as long, 0 disables it
+	StreamPollSec     int      // a ?stream looks for new flaps this often
+	MaxStreams        int      // open ?stream connections of a client, 0 is unlimited
+	MaxChartWidth     int      // largest width of a flap chart in pixels
+	MaxChartHeight    int      // largest height of a chart strip in pixels
+	MaxBodyBytes      int      // largest JSON body of a POST query
+	TLSCertFile       string
+	TLSKeyFile        string
+	Colors            ColorsConfig
+	Columns           ColumnsConfig
+	// Reviews, events and stats running at once, 0 is unlimited.
+	// Requests beyond wait QueryQueueSec for one of them to finish.
+	MaxConcurrentQueries int
+	QueryQueueSec        int
+	// Recurring windows whose flaps are left out of reviews, clock times are in MuteTimeZone
+	MuteWindows  []MuteWindow
+	MuteTimeZone string
+	// Collector databases selected with ?source, DefaultSource is used without it.
+	// Without a DefaultSource the DB settings above are.
+	Sources       map[string]SourceConfig
+	DefaultSource string
+}
+
+// SourceConfig is the database of a collector, omitted settings are taken from Config
+type SourceConfig struct {
+	DBDriver       string
+	DBHost         string
+	DBName         string
+	DBUser         string
+	DBPassword     string
+	DBPasswordFile string
+	DBTable        string
+	DBFixture      string
+}
+
+// ForSource returns the config with the database settings of a source
+func (c Config) ForSource(name string) Config {
+	source := c.Sources[name]
+	if source.DBDriver != "" {
+		c.DBDriver = source.DBDriver
+	}
+	if source.DBHost != "" {
+		c.DBHost = source.DBHost
+	}
+	if source.DBName != "" {
+		c.DBName = source.DBName
+	}
+	if source.DBUser != "" {
+		c.DBUser = source.DBUser
+	}
+	if source.DBPassword != "" {
+		c.DBPassword = source.DBPassword
+		c.DBPasswordFile = ""
+	}
+	if source.DBPasswordFile != "" {
+		c.DBPasswordFile = source.DBPasswordFile
+	}
+	if source.DBTable != "" {
+		c.DBTable = source.DBTable
+	}
+	if source.DBFixture != "" {
+		c.DBFixture = source.DBFixture
+	}
+	return c
+}
+
+// ColorsConfig holds flap chart colors as #RRGGBB strings
+type ColorsConfig struct {
+	Up        string
+	UpState   string
+	Down      string
+	DownState string
+	Flapping  string
+	Unknown   string
+	AdminDown string
+}
+
+// ColumnsConfig maps the fields of a ports row to the column names of DBTable
+type ColumnsConfig struct {
+	Id           string
+	Sid          string
+	Time         string
+	TimeTicks    string
+	Ipaddress    string
+	Hostname     string
+	IfIndex      string
+	IfName       string
+	IfAlias      string
+	IfOperStatus string
+	// Only read with DBExtendedColumns
+	IfSpeed       string
+	IfAdminStatus string
+}
+
+// Column returns the column name of a field named as in the snmpflapd schema
+func (c ColumnsConfig) Column(field string) string {
+	switch field {
+	case "id":
+		return c.Id
+	case "sid":
+		return c.Sid
+	case "time":
+		return c.Time
+	case "timeticks":
+		return c.TimeTicks
+	case "ipaddress":
+		return c.Ipaddress
+	case "hostname":
+		return c.Hostname
+	case "ifIndex":
+		return c.IfIndex
+	case "ifName":
+		return c.IfName
+	case "ifAlias":
+		return c.IfAlias
+	case "ifOperStatus":
+		return c.IfOperStatus
+	case "ifSpeed":
+		return c.IfSpeed
+	case "ifAdminStatus":
+		return c.IfAdminStatus
+	}
+	return field
+}
+
+// Validate checks that every column name can be put into a query as is
+func (c ColumnsConfig) Validate() error {
+	fields := []struct{ name, column string }{
+		{"Id", c.Id},
+		{"Sid", c.Sid},
+		{"Time", c.Time},
+		{"TimeTicks", c.TimeTicks},
+		{"Ipaddress", c.Ipaddress},
+		{"Hostname", c.Hostname},
+		{"IfIndex", c.IfIndex},
+		{"IfName", c.IfName},
+		{"IfAlias", c.IfAlias},
+		{"IfOperStatus", c.IfOperStatus},
+		{"IfSpeed", c.IfSpeed},
+		{"IfAdminStatus", c.IfAdminStatus},
+	}
+	for _, field := range fields {
+		if !sqlIdentifierRe.MatchString(field.column) {
+			return fmt.Errorf("invalid column name %s = %q", field.name, field.column)
+		}
+	}
+	return nil
 }
 
 var config = Config{
-	LogFilename:   defaultLogFilename,
-	ListenAddress: defaultListenAddress,
-	ListenPort:    defaultListenPort,
-	DBHost:        defaultDBHost,
-	DBName:        defaultDBName,
-	DBUser:        defaultDBUser,
-	DBPassword:    defaultDBPassword,
+	ListenAddress:     defaultListenAddress,
+	ListenPort:        defaultListenPort,
+	DBDriver:          defaultDBDriver,
+	DBHost:            defaultDBHost,
+	DBName:            defaultDBName,
+	DBUser:            defaultDBUser,
+	DBPassword:        defaultDBPassword,
+	DBTable:           defaultDBTable,
+	QueryTimeoutSec:   defaultQueryTimeout,
+	ReadTimeoutSec:    defaultReadTimeout,
+	WriteTimeoutSec:   defaultWriteTimeout,
+	IdleTimeoutSec:    defaultIdleTimeout,
+	DBConnMaxIdleSec:  defaultDBConnMaxIdle,
+	RateBurst:         defaultRateBurst,
+	FlapThreshold:     defaultFlapThreshold,
+	MinTransitions:    defaultMinTransitions,
+	CoverageScope:     coverageScopeWindow,
+	ChartColumnState:  chartColumnStateLast,
+	TimeFormat:        time.RFC3339Nano,
+	LogLevel:          "info",
+	BannerText:        "FlapMyPort API is ready",
+	MaxRecentFlaps:    defaultMaxRecentFlaps,
+	DiscoveryLimit:    defaultDiscoveryLimit,
+	StaleCollectorSec: defaultStaleCollector,
+	RecentlyActiveSec: defaultRecentlyActive,
+	StreamPollSec:     defaultStreamPoll,
+	MaxStreams:        defaultMaxStreams,
+	MaxChartWidth:     defaultMaxChartWidth,
+	MaxChartHeight:    defaultMaxChartHeight,
+	MaxBodyBytes:      defaultMaxBodyBytes,
+	QueryQueueSec:     defaultQueryQueue,
+	ExcludeIfNames: []string{
+		"%.%", // subinterfaces
+		"Vlan%",
+		"Loopback%",
+		"Null%",
+	},
+	Colors: ColorsConfig{
+		Up:        defaultColorUp,
+		UpState:   defaultColorUpState,
+		Down:      defaultColorDown,
+		DownState: defaultColorDownState,
+		Flapping:  defaultColorFlapping,
+		Unknown:   defaultColorUnknown,
+		AdminDown: defaultColorAdminDown,
+	},
+	Columns: ColumnsConfig{
+		Id:            "id",
+		Sid:           "sid",
+		Time:          "time",
+		TimeTicks:     "timeticks",
+		Ipaddress:     "ipaddress",
+		Hostname:      "hostname",
+		IfIndex:       "ifIndex",
+		IfName:        "ifName",
+		IfAlias:       "ifAlias",
+		IfOperStatus:  "ifOperStatus",
+		IfSpeed:       "ifSpeed",
+		IfAdminStatus: "ifAdminStatus",
+	},
+}
+
+// ConfigErrors lists every problem Validate found
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dbErrors checks the database settings, prefix tells which source they belong to
+func (c *Config) dbErrors(prefix string) ConfigErrors {
+	var errs ConfigErrors
+
+	if _, ok := dialects[c.DBDriver]; !ok {
+		errs = append(errs, fmt.Errorf("%sunsupported DBDriver %q", prefix, c.DBDriver))
+	}
+	if c.DBName == "" {
+		errs = append(errs, fmt.Errorf("%sDBName is empty", prefix))
+	}
+	// A SQLite database is a local file
+	if c.DBDriver != driverSQLite {
+		if c.DBHost == "" {
+			errs = append(errs, fmt.Errorf("%sDBHost is empty", prefix))
+		}
+		if c.DBUser == "" {
+			errs = append(errs, fmt.Errorf("%sDBUser is empty", prefix))
+		}
+	}
+	if !sqlIdentifierRe.MatchString(c.DBTable) {
+		errs = append(errs, fmt.Errorf("%sinvalid DBTable %q", prefix, c.DBTable))
+	}
+	if c.DBPasswordFile != "" {
+		if _, err := readPasswordFile(c.DBPasswordFile); err != nil {
+			errs = append(errs, fmt.Errorf("%sDBPasswordFile: %s", prefix, err))
+		}
+	}
+	return errs
+}
+
+// readPasswordFile reads a password from a file, ignoring the newline it ends with
+func readPasswordFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Validate checks the loaded config and reports all problems at once
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+
+	if c.ListenSocket == "" && (c.ListenPort < 1 || c.ListenPort > 65535) {
+		errs = append(errs, fmt.Errorf("ListenPort %d is out of range 1-65535", c.ListenPort))
+	}
+
+	errs = append(errs, c.dbErrors("")...)
+	for name := range c.Sources {
+		source := c.ForSource(name)
+		errs = append(errs, source.dbErrors(fmt.Sprintf("source %q: ", name))...)
+	}
+	if _, ok := c.Sources[c.DefaultSource]; c.DefaultSource != "" && !ok {
+		errs = append(errs, fmt.Errorf("DefaultSource %q is not in Sources", c.DefaultSource))
+	}
+	if err := c.Columns.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch c.DBTLS {
+	case "", dbTLSDisabled, dbTLSPreferred, dbTLSRequired:
+	default:
+		errs = append(errs, fmt.Errorf("DBTLS must be %s, %s or %s", dbTLSDisabled, dbTLSPreferred, dbTLSRequired))
+	}
+	if c.DBTLS != "" && c.DBTLS != dbTLSDisabled && c.DBDriver != driverMySQL {
+		errs = append(errs, errors.New("DBTLS is only supported with MySQL"))
+	}
+	switch c.DBSSLMode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		errs = append(errs, errors.New("DBSSLMode must be disable, require, verify-ca or verify-full"))
+	}
+	if c.DBSSLMode != "" && c.DBDriver != driverPostgres {
+		errs = append(errs, errors.New("DBSSLMode is only supported with PostgreSQL"))
+	}
+	if (c.DBTLSCert == "") != (c.DBTLSKey == "") {
+		errs = append(errs, errors.New("both DBTLSCert and DBTLSKey must be set"))
+	}
+
+	if c.QueryTimeoutSec < 0 {
+		errs = append(errs, errors.New("QueryTimeoutSec is negative"))
+	}
+	if c.ReadTimeoutSec < 0 || c.WriteTimeoutSec < 0 || c.IdleTimeoutSec < 0 {
+		errs = append(errs, errors.New("ReadTimeoutSec, WriteTimeoutSec and IdleTimeoutSec must not be negative"))
+	}
+	if c.DBConnMaxIdleSec < 0 {
+		errs = append(errs, errors.New("DBConnMaxIdleSec is negative"))
+	}
+	if c.DBKeepaliveSec < 0 {
+		errs = append(errs, errors.New("DBKeepaliveSec is negative"))
+	}
+	if c.MaxWindowHours < 0 {
+		errs = append(errs, errors.New("MaxWindowHours is negative"))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, errors.New("RateLimit is negative"))
+	}
+	if c.StaleCollectorSec < 0 {
+		errs = append(errs, errors.New("StaleCollectorSec is negative"))
+	}
+	if c.RecentlyActiveSec < 0 {
+		errs = append(errs, errors.New("RecentlyActiveSec is negative"))
+	}
+	if c.MaxHosts < 0 {
+		errs = append(errs, errors.New("MaxHosts is negative"))
+	}
+	if c.DiscoveryLimit < 0 {
+		errs = append(errs, errors.New("DiscoveryLimit is negative"))
+	}
+	if c.ReviewCacheTTLSec < 0 {
+		errs = append(errs, errors.New("ReviewCacheTTLSec is negative"))
+	}
+	if c.StreamPollSec < 1 {
+		errs = append(errs, errors.New("StreamPollSec must be at least 1"))
+	}
+	if c.MaxStreams < 0 {
+		errs = append(errs, errors.New("MaxStreams is negative"))
+	}
+	if c.MaxChartWidth < flapChartWidth || c.MaxChartHeight < flapChartHeight {
+		errs = append(errs, fmt.Errorf("MaxChartWidth and MaxChartHeight must be at least %d and %d", flapChartWidth, flapChartHeight))
+	}
+	if c.MaxBodyBytes < 1 {
+		errs = append(errs, errors.New("MaxBodyBytes must be at least 1"))
+	}
+	if c.MaxConcurrentQueries < 0 || c.QueryQueueSec < 0 {
+		errs = append(errs, errors.New("MaxConcurrentQueries and QueryQueueSec must not be negative"))
+	}
+	if c.MaxRecentFlaps < 1 {
+		errs = append(errs, errors.New("MaxRecentFlaps must be at least 1"))
+	}
+	if c.FlapThreshold < 1 {
+		errs = append(errs, errors.New("FlapThreshold must be at least 1"))
+	}
+	if c.MinTransitions < 1 {
+		errs = append(errs, errors.New("MinTransitions must be at least 1"))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LogLevel: %s", err))
+	}
+	if c.TimeFormat == "" {
+		errs = append(errs, errors.New("TimeFormat is empty"))
+	}
+	if c.CoverageScope != coverageScopeWindow && c.CoverageScope != coverageScopeTable {
+		errs = append(errs, fmt.Errorf("CoverageScope must be %s or %s", coverageScopeWindow, coverageScopeTable))
+	}
+	if c.ChartColumnState != chartColumnStateLast && c.ChartColumnState != chartColumnStateDominant {
+		errs = append(errs, fmt.Errorf("ChartColumnState must be %s or %s", chartColumnStateLast, chartColumnStateDominant))
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		errs = append(errs, errors.New("RateBurst must be at least 1"))
+	}
+
+	if _, err := c.Colors.Palette(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid chart color: %s", err))
+	}
+
+	if _, err := compileMuteSchedule(c.MuteTimeZone, c.MuteWindows); err != nil {
+		errs = append(errs, fmt.Errorf("MuteWindows: %s", err))
+	}
+
+	if _, err := parseCIDRs(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("TrustedProxies: %s", err))
+	}
+
+	if c.TrustProxy && len(c.TrustedProxies) == 0 {
+		errs = append(errs, errors.New("TrustProxy is set without TrustedProxies"))
+	}
+
+	if c.BasicAuthUser == "" && c.BasicAuthPassword != "" {
+		errs = append(errs, errors.New("BasicAuthPassword is set without BasicAuthUser"))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("both TLSCertFile and TLSKeyFile must be set to enable TLS"))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 func (c *Config) SqlDSN() string {
-	return fmt.Sprintf(
+	if c.DBDriver == driverSQLite {
+		if c.DBName == sqliteMemory {
+			// Every pooled connection must see the same in-memory database
+			return "file::memory:?cache=shared"
+		}
+		return c.DBName
+	}
+
+	if c.DBDriver == driverPostgres {
+		dsn := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(c.DBUser, c.DBPassword),
+			Host:   c.DBHost,
+			Path:   "/" + c.DBName,
+		}
+		if c.DBSSLMode != "" {
+			dsn.RawQuery = url.Values{"sslmode": {c.DBSSLMode}}.Encode()
+		}
+		return dsn.String()
+	}
+
+	dsn := fmt.Sprintf(
 		"%s:%s@tcp(%s)/%s?parseTime=true",
 		c.DBUser,
 		c.DBPassword,
 		c.DBHost,
 		c.DBName,
 	)
+
+	switch {
+	case c.mysqlCustomTLS():
+		dsn += "&tls=" + mysqlTLSConfigName
+	case c.DBTLS == dbTLSRequired:
+		dsn += "&tls=true"
+	case c.DBTLS == dbTLSPreferred:
+		dsn += "&tls=preferred"
+	}
+	return dsn
+}
+
+// mysqlCustomTLS tells whether the connection needs a TLS config of its own.
+// Certificates are only used in required mode, preferred mode doesn't verify the server.
+func (c *Config) mysqlCustomTLS() bool {
+	return c.DBTLS == dbTLSRequired && (c.DBTLSCA != "" || c.DBTLSCert != "")
 }
 
 var (
@@ -88,28 +742,128 @@ var (
 	flagVerbose        bool
 	flagConfigFilename string
 	flagVersion        bool
-
-	ColorUp        = color.RGBA{R: 10, G: 178, B: 38, A: 0xff}
-	ColorUpState   = color.RGBA{R: 125, G: 212, B: 139, A: 0xff}
-	ColorDown      = color.RGBA{R: 212, G: 57, B: 57, A: 0xff}
-	ColorDownState = color.RGBA{R: 239, G: 106, B: 106, A: 0xff}
-	ColorFlapping  = color.RGBA{R: 255, G: 128, B: 0, A: 0xff}
-	ColorUnknown   = color.RGBA{R: 200, G: 200, B: 200, A: 0xff}
 )
 
+// Palette is a parsed ColorsConfig used to draw flap charts
+type Palette struct {
+	Up        color.RGBA
+	UpState   color.RGBA
+	Down      color.RGBA
+	DownState color.RGBA
+	Flapping  color.RGBA
+	Unknown   color.RGBA
+	AdminDown color.RGBA
+}
+
+// Palette parses every configured color, failing on the first invalid one
+func (c *ColorsConfig) Palette() (Palette, error) {
+	p := Palette{}
+
+	colors := []struct {
+		name  string
+		value string
+		dst   *color.RGBA
+	}{
+		{"Up", c.Up, &p.Up},
+		{"UpState", c.UpState, &p.UpState},
+		{"Down", c.Down, &p.Down},
+		{"DownState", c.DownState, &p.DownState},
+		{"Flapping", c.Flapping, &p.Flapping},
+		{"Unknown", c.Unknown, &p.Unknown},
+		{"AdminDown", c.AdminDown, &p.AdminDown},
+	}
+
+	for _, entry := range colors {
+		parsed, err := parseHexColor(entry.value)
+		if err != nil {
+			return p, fmt.Errorf("Colors.%s: %s", entry.name, err)
+		}
+		*entry.dst = parsed
+	}
+	return p, nil
+}
+
+// parseHexColor converts "#RRGGBB" to an opaque color.RGBA
+func parseHexColor(s string) (color.RGBA, error) {
+	c := color.RGBA{A: 0xff}
+
+	if len(s) != 7 || s[0] != '#' {
+		return c, fmt.Errorf("%q is not in #RRGGBB format", s)
+	}
+
+	value, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return c, fmt.Errorf("%q is not in #RRGGBB format", s)
+	}
+
+	c.R = uint8(value >> 16)
+	c.G = uint8(value >> 8)
+	c.B = uint8(value)
+	return c, nil
+}
+
 // DATA FORMATS
 
 type CheckResult struct {
 	CheckResult string `json:"checkResult"`
+	DB          string `json:"db,omitempty"` // with deep=1
 }
 
 type QueryParams struct {
 	action  string
 	IfIndex int
-	Host    string
+	// A list of ifindexes asks for a stacked chart
+	IfIndexes []int
+	// Ports of a host overview chart are labelled
+	labels []string
+	Host   string
+	// A review of exactly these addresses, from a comma-separated host
+	Hosts   []string
 	Start   time.Time
 	End     time.Time
 	Filter  Filter
+	Format  string
+	AfterID int
+	Limit   int
+	Offset  int
+	Count   int
+	// IncludeSubIf disables ExcludeIfNames
+	IncludeSubIf    bool
+	GroupBy         string
+	HideBlacklisted bool
+	// Hosts in a review, the most flapping ones are kept
+	MaxHosts int
+	// Name of the collector database to query, empty for the default one
+	Source string
+	// Report the collector session that recorded each flap
+	IncludeSid bool
+	// ?check pings the database too
+	Deep bool
+	// Ports with fewer status changes are left out of the review, 0 is MinTransitions
+	MinTransitions int
+	// Only ports last seen in this ifOperStatus are reviewed, empty for all
+	Status string
+	// Shorter down and up pairs aren't counted by the review
+	Debounce time.Duration
+	// ?stats buckets flaps by hour or day unless TopN asks for the most flapping hosts or ports
+	Bucket string
+	TopN   int
+	TopBy  string
+	// Size of a chart strip, 0 for flapChartWidth and flapChartHeight
+	Width  int
+	Height int
+}
+
+// chartSize returns the size of a chart strip asked for by q
+func (q QueryParams) chartSize() (int, int) {
+	width, height := q.Width, q.Height
+	if width == 0 {
+		width = flapChartWidth
+	}
+	if height == 0 {
+		height = flapChartHeight
+	}
+	return width, height
 }
 
 // PortRow is a DB row representation
@@ -123,49 +877,182 @@ type PortRow struct {
 	IfIndex      int
 	IfName       *string
 	IfAlias      *string
-	IfOperStatus string
+	IfOperStatus string // "unknown" when NULL in the DB
+	// Only read with DBExtendedColumns
+	IfSpeed       *int64
+	IfAdminStatus *string
 }
 
 func (p *PortRow) CreateFlap() Flap {
 	return Flap{
-		Time:         p.Time,
+		Id:           p.Id,
+		Time:         JSONTime{p.Time},
 		IfOperStatus: p.IfOperStatus,
+		AdminInduced: p.IsAdminDown() && p.IfOperStatus == ifStatusDownCaption,
+		TimeTicks:    p.TimeTicks,
+		Sid:          p.Sid,
 	}
 
 }
 
+// IsAdminDown reports a port shut down by an operator.
+// It's always false without DBExtendedColumns as IfAdminStatus isn't read then.
+func (p *PortRow) IsAdminDown() bool {
+	return p.IfAdminStatus != nil && *p.IfAdminStatus == ifStatusDownCaption
+}
+
 type ReviewResult struct {
 	Params Params `json:"params"`
 	Hosts  []Host `json:"hosts"`
 }
 
+// countTotals sums up the hosts that made it into the result
+func (r *ReviewResult) countTotals() {
+	r.Params.TotalHosts = len(r.Hosts)
+	r.Params.TotalPorts = 0
+	r.Params.TotalFlaps = 0
+
+	for _, host := range r.Hosts {
+		r.Params.TotalPorts += len(host.Ports)
+		for _, port := range host.Ports {
+			r.Params.TotalFlaps += port.FlapCount
+		}
+	}
+}
+
+// limitHosts keeps the max hosts with the most flaps in their original order
+func (r *ReviewResult) limitHosts(max int) {
+	if max <= 0 || len(r.Hosts) <= max {
+		return
+	}
+
+	flaps := make([]int, len(r.Hosts))
+	order := make([]int, len(r.Hosts))
+	for i, host := range r.Hosts {
+		order[i] = i
+		for _, port := range host.Ports {
+			flaps[i] += port.FlapCount
+		}
+	}
+	// Ties are broken by address, so repeated requests keep the same hosts
+	sort.SliceStable(order, func(a, b int) bool {
+		if flaps[order[a]] != flaps[order[b]] {
+			return flaps[order[a]] > flaps[order[b]]
+		}
+		return r.Hosts[order[a]].Ipaddress < r.Hosts[order[b]].Ipaddress
+	})
+
+	kept := order[:max]
+	sort.Ints(kept)
+	hosts := make([]Host, 0, max)
+	for _, i := range kept {
+		hosts = append(hosts, r.Hosts[i])
+	}
+	r.Hosts = hosts
+	r.Params.Truncated = true
+}
+
+// JSONTime is a time in responses, formatted with TimeFormat
+type JSONTime struct {
+	time.Time
+}
+
+func (t JSONTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Format(config.TimeFormat))
+}
+
+// jsonTime returns a JSONTime pointer of a time, e.g. for optional fields
+func jsonTime(t time.Time) *JSONTime {
+	return &JSONTime{t}
+}
+
 type Params struct {
-	TimeStart     *time.Time `json:"timeStart"`
-	TimeEnd       *time.Time `json:"timeEnd"`
-	FirstFlapTime *time.Time `json:"firstFlapTime"`
-	LastFlapTime  *time.Time `json:"lastFlapTime"`
-	OldestFlapID  int        `json:"oldestFlapID"`
+	TimeStart     *JSONTime `json:"timeStart"`
+	TimeEnd       *JSONTime `json:"timeEnd"`
+	FirstFlapTime *JSONTime `json:"firstFlapTime"`
+	LastFlapTime  *JSONTime `json:"lastFlapTime"`
+	OldestFlapID  int       `json:"oldestFlapID"`
+	NewestFlapID  int       `json:"newestFlapID"`
+	TotalFlaps    int       `json:"totalFlaps"`
+	TotalPorts    int       `json:"totalPorts"`
+	TotalHosts    int       `json:"totalHosts"`
+	// Newest flap id in the window regardless of the filter, reported to afterId polls
+	LatestFlapID int `json:"latestFlapID,omitempty"`
+	// Hosts were left out by maxhosts, the totals still count them
+	Truncated bool `json:"truncated,omitempty"`
+	// Oldest and newest rows the collector wrote, nothing is known outside of them
+	CoverageStart *JSONTime `json:"coverageStart,omitempty"`
+	CoverageEnd   *JSONTime `json:"coverageEnd,omitempty"`
 }
 
 type Flap struct {
-	Time         time.Time
-	IfOperStatus string
+	Id           int      `json:"id"`
+	Time         JSONTime `json:"time"`
+	IfOperStatus string   `json:"ifOperStatus"`
+	// The port went down because it was shut down, not because the link failed
+	AdminInduced bool `json:"adminInduced,omitempty"`
+	// Device uptime of the trap, orders flaps sharing the same second
+	TimeTicks int64 `json:"-"`
+	// Seconds until the port changed its status again, set by PortFlaps
+	DurationSec *int64 `json:"durationSec,omitempty"`
+	// Collector session that recorded the flap, with includesid
+	Sid string `json:"sid,omitempty"`
+}
+
+// Before tells whether a flap happened before another one
+func (f Flap) Before(other Flap) bool {
+	if !f.Time.Equal(other.Time.Time) {
+		return f.Time.Before(other.Time.Time)
+	}
+	return f.TimeTicks < other.TimeTicks
+}
+
+func (flap *Flap) IsUp() bool {
+	return flap.IfOperStatus == ifStatusUpCaption
+}
+
+func (flap *Flap) IsDown() bool {
+	return flap.IfOperStatus == ifStatusDownCaption
 }
 
 func (flap *Flap) FromDB(row PortRow) {
-	flap.Time = row.Time
+	flap.Time = JSONTime{row.Time}
 	flap.IfOperStatus = row.IfOperStatus
+	flap.AdminInduced = row.IsAdminDown() && row.IfOperStatus == ifStatusDownCaption
 }
 
 type PortView struct {
-	IfIndex       int        `json:"ifIndex"`
-	IfName        string     `json:"ifName"`
-	IfAlias       string     `json:"ifAlias"`
-	IfOperStatus  string     `json:"ifOperStatus"`
-	FlapCount     int        `json:"flapCount"`
-	FirstFlapTime *time.Time `json:"firstFlapTime"` // why?
-	LastFlapTime  *time.Time `json:"lastFlapTime"`  // why?
-	IsBlacklisted bool       `json:"isBlacklisted"`
+	IfIndex       int       `json:"ifIndex"`
+	IfName        string    `json:"ifName"`
+	IfAlias       string    `json:"ifAlias"`
+	IfOperStatus  string    `json:"ifOperStatus"`
+	FlapCount     int       `json:"flapCount"`
+	Transitions   int       `json:"transitions"`   // changes between up and down
+	FlapRate      float64   `json:"flapRate"`      // flaps per minute of the window
+	Status        string    `json:"status"`        // one of portStatus*
+	FirstFlapTime *JSONTime `json:"firstFlapTime"` // why?
+	LastFlapTime  *JSONTime `json:"lastFlapTime"`  // why?
+	IsBlacklisted bool      `json:"isBlacklisted,omitempty"`
+	Sid           string    `json:"sid,omitempty"` // of the latest flap, with includesid
+	IfSpeed       *int64    `json:"ifSpeed"`
+	IfAdminStatus *string   `json:"ifAdminStatus"`
+	// The last flap is at most RecentlyActiveSec before the window end, the port may still be flapping
+	RecentlyActive bool `json:"recentlyActive"`
+	// ifIndexes of the ports merged into this one with groupby=alias
+	Members []int `json:"members,omitempty"`
+	// The last known status, repeated traps of it aren't transitions
+	lastStatus string
+}
+
+// countTransition counts a row changing the known status of the port
+func (p *PortView) countTransition(r PortRow) {
+	if r.IfOperStatus != ifStatusUpCaption && r.IfOperStatus != ifStatusDownCaption {
+		return
+	}
+	if r.IfOperStatus != p.lastStatus {
+		p.Transitions++
+		p.lastStatus = r.IfOperStatus
+	}
 }
 
 func (p *PortView) FromDB(r PortRow) {
@@ -181,10 +1068,15 @@ func (p *PortView) FromDB(r PortRow) {
 		p.IfAlias = *r.IfAlias
 	}
 
-	p.FirstFlapTime = &r.Time
-	p.LastFlapTime = &r.Time
+	p.FirstFlapTime = jsonTime(r.Time)
+	p.LastFlapTime = jsonTime(r.Time)
 	p.FlapCount = 1
 	p.IfOperStatus = r.IfOperStatus
+	p.Sid = r.Sid
+	p.countTransition(r)
+	p.IfSpeed = r.IfSpeed
+	p.IfAdminStatus = r.IfAdminStatus
+	p.IsBlacklisted = blacklist.Match(r)
 }
 
 func (p *PortView) updateFromDB(r PortRow) {
@@ -196,12 +1088,21 @@ func (p *PortView) updateFromDB(r PortRow) {
 		p.IfAlias = *r.IfAlias
 	}
 
-	if r.Time.Before(*p.FirstFlapTime) {
-		p.FirstFlapTime = &r.Time
-	} else if r.Time.After(*p.LastFlapTime) {
-		p.LastFlapTime = &r.Time
+	if r.Time.Before(p.FirstFlapTime.Time) {
+		p.FirstFlapTime = jsonTime(r.Time)
+	} else if r.Time.After(p.LastFlapTime.Time) {
+		p.LastFlapTime = jsonTime(r.Time)
 	}
 	p.IfOperStatus = r.IfOperStatus
+	p.Sid = r.Sid
+	p.countTransition(r)
+
+	if r.IfSpeed != nil {
+		p.IfSpeed = r.IfSpeed
+	}
+	if r.IfAdminStatus != nil {
+		p.IfAdminStatus = r.IfAdminStatus
+	}
 }
 
 type Host struct {
@@ -244,550 +1145,5278 @@ func (h *Host) UpdateFromDB(r PortRow) {
 
 }
 
+// GroupByAlias merges ports sharing the same non-empty ifAlias, e.g. LAG members
+func (h *Host) GroupByAlias() {
+	ports := make([]PortView, 0, len(h.Ports))
+	groups := make(map[string]int)
+
+	for _, port := range h.Ports {
+		if port.IfAlias == "" {
+			ports = append(ports, port)
+			continue
+		}
+
+		i, ok := groups[port.IfAlias]
+		if !ok {
+			port.Members = []int{port.IfIndex}
+			groups[port.IfAlias] = len(ports)
+			ports = append(ports, port)
+			continue
+		}
+
+		group := &ports[i]
+		group.Members = append(group.Members, port.IfIndex)
+		group.FlapCount += port.FlapCount
+		group.Transitions += port.Transitions
+
+		if port.FirstFlapTime.Before(group.FirstFlapTime.Time) {
+			group.FirstFlapTime = port.FirstFlapTime
+		}
+		// The group is in the state of its most recently changed member
+		if port.LastFlapTime.After(group.LastFlapTime.Time) {
+			group.LastFlapTime = port.LastFlapTime
+			group.IfOperStatus = port.IfOperStatus
+		}
+	}
+
+	h.Ports = ports
+}
+
 // FLAPCHART
 
 type FlapsDiagram struct {
-	img *image.RGBA
+	img         *image.RGBA
+	labelHeight int
+	height      int // of a strip without its label
+}
+
+func (f *FlapsDiagram) stripHeight() int {
+	return f.labelHeight + f.height + flapChartStripGap
 }
 
-func (f *FlapsDiagram) drawCol(x int, color color.RGBA) {
-	for y := 0; y < flapChartHeight; y++ {
+func (f *FlapsDiagram) drawCol(x int, top int, color color.RGBA) {
+	for y := top; y < top+f.height; y++ {
 		f.img.Set(x, y, color)
 	}
 }
 
-func CreateFlapsDiagram() *FlapsDiagram {
+// drawStrip draws the chart of a port as the n-th strip of the diagram
+func (f *FlapsDiagram) drawStrip(n int, colorLine []color.RGBA) {
+	top := n*f.stripHeight() + f.labelHeight
+	for x, currentColor := range colorLine {
+		f.drawCol(x, top, currentColor)
+	}
+}
 
-	upLeft := image.Point{X: 0, Y: 0}
-	lowRight := image.Point{X: flapChartWidth, Y: flapChartHeight}
+// drawLabel writes a caption above the n-th strip, cut to the chart width
+func (f *FlapsDiagram) drawLabel(n int, label string) {
+	face := basicfont.Face7x13
+	if maxChars := f.img.Bounds().Dx() / face.Advance; len(label) > maxChars {
+		label = label[:maxChars]
+	}
 
-	flapsDiagram := FlapsDiagram{
-		img: image.NewRGBA(image.Rectangle{Min: upLeft, Max: lowRight}),
+	drawer := font.Drawer{
+		Dst:  f.img,
+		Src:  image.NewUniform(color.Black),
+		Face: face,
+		Dot:  fixed.P(0, n*f.stripHeight()+face.Ascent),
 	}
-	return &flapsDiagram
+	drawer.DrawString(label)
 }
 
-// FLAPPER
+func CreateFlapsDiagram(width int, height int) *FlapsDiagram {
+	return createStackedDiagram(1, 0, width, height)
+}
 
-type Flapper struct {
-	db *sql.DB
+// createStackedDiagram makes room for charts of several ports, one under another.
+// Strips are split by a transparent line and may have a label line above.
+func createStackedDiagram(strips int, labelHeight int, width int, height int) *FlapsDiagram {
+
+	flapsDiagram := FlapsDiagram{labelHeight: labelHeight, height: height}
+
+	upLeft := image.Point{X: 0, Y: 0}
+	lowRight := image.Point{X: width, Y: strips*flapsDiagram.stripHeight() - flapChartStripGap}
+
+	flapsDiagram.img = image.NewRGBA(image.Rectangle{Min: upLeft, Max: lowRight})
+	return &flapsDiagram
 }
 
-func createFlapper(dsn string) (*Flapper, error) {
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, err
-	}
+// FLAPCHART CACHE
 
-	f := &Flapper{db: db}
-	return f, nil
+type chartCacheEntry struct {
+	key         string
+	contentType string
+	body        []byte
+	expires     time.Time // zero never expires
+	truncated   string    // headerFlapChartTruncated of a host overview chart
+}
 
+// ChartCache is a small LRU of encoded flap charts keyed by ETag.
+// It also keeps serialized reviews for a short while.
+type ChartCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
 }
 
-type Filter struct {
-	Conditions []string
+func createChartCache(size int) *ChartCache {
+	return &ChartCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
 }
 
-func (f *Filter) ParseFilter(v url.Values) {
-	filter, ok := v["filter"]
+func (c *ChartCache) Get(key string) (chartCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
 	if !ok {
-		return
+		return chartCacheEntry{}, false
+	}
+	entry := element.Value.(chartCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return chartCacheEntry{}, false
 	}
+	c.order.MoveToFront(element)
+	return entry, true
+}
 
-	keywords := strings.Fields(filter[0])
-	for _, kw := range keywords {
-		if strings.HasPrefix(kw, "!") {
-			if len(kw) < 2 {
-				continue
-			}
-			kw = kw[1:]
-			condition := fmt.Sprintf(`AND (hostname 
-				NOT LIKE "%%%[1]s%%" AND ipaddress 
-				NOT LIKE "%%%[1]s%%" AND ifAlias 
-				NOT LIKE "%%%[1]s%%")`,
-				kw,
-			)
-			f.Conditions = append(f.Conditions, condition)
+func (c *ChartCache) Add(entry chartCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		} else {
-			condition := fmt.Sprintf(`AND (hostname 
-			LIKE "%%%[1]s%%" OR ipaddress 
-			LIKE "%%%[1]s%%" OR ifAlias 
-			LIKE "%%%[1]s%%")`,
-				kw,
-			)
-			f.Conditions = append(f.Conditions, condition)
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
 
-		}
+	c.entries[entry.key] = c.order.PushFront(entry)
 
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(chartCacheEntry).key)
 	}
 }
 
-func (f *Flapper) Review(startTime, endTime time.Time, filter Filter) (ReviewResult, error) {
+// RATE LIMITER
 
-	SQLQuery := fmt.Sprintf(`SELECT id,
- 		sid, 
-		CONVERT_TZ(time, @@session.time_zone, 'UTC'),
-		timeticks,
-		ipaddress, 
-		hostname, 
-		ifIndex, 
-		ifName, 
-		ifAlias, 
-		ifOperStatus
-		FROM ports 
-		WHERE CONVERT_TZ(time, @@session.time_zone, 'UTC') >= '%s' 
-		AND CONVERT_TZ(time, @@session.time_zone, 'UTC') <= '%s'
-		AND ifName NOT LIKE '%%.%%'
-		%s
-		ORDER BY ipaddress, ifIndex, time ASC, timeticks ASC LIMIT %d;`,
-		startTime.Format(timeFormat),
-		endTime.Format(timeFormat),
-		strings.Join(filter.Conditions, " "),
-		sqlRowsLimit,
-	)
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
 
-	result := ReviewResult{
-		Hosts: make([]Host, 0, 100),
-		Params: Params{
-			TimeStart: &startTime,
-			TimeEnd:   &endTime,
-		},
+// RateLimiter is a per-client token bucket limiter
+type RateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func createRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
 	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
 
-	host := &Host{}
+// Allow takes a token from the client's bucket.
+// When the bucket is empty it returns the time until the next token.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	for _, portRow := range f.FetchFromDB(SQLQuery) {
+	now := time.Now()
+	l.sweep(now)
 
-		// 0 instead of nil if no flaps because clients crashed seeing null :)
-		if result.Params.OldestFlapID == 0 {
-			result.Params.OldestFlapID = portRow.Id
-		}
-
-		if result.Params.FirstFlapTime == nil {
-			result.Params.FirstFlapTime = &portRow.Time
-		}
-		result.Params.LastFlapTime = &portRow.Time
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[client] = bucket
+	}
 
-		if host.Ipaddress == "" {
-			host.FromDB(portRow)
+	bucket.tokens += now.Sub(bucket.lastSeen).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.lastSeen = now
 
-		} else if host.Ipaddress == portRow.Ipaddress {
-			host.UpdateFromDB(portRow)
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
 
-		} else {
-			result.Hosts = append(result.Hosts, *host)
-			host = &Host{}
-			host.FromDB(portRow)
+// sweep forgets clients whose buckets have refilled completely
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
 
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for client, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) > refill {
+			delete(l.buckets, client)
 		}
-
-	}
-	if host.Ipaddress != "" {
-		result.Hosts = append(result.Hosts, *host)
 	}
-	return result, nil
-
 }
 
-func (f *Flapper) FetchFromDB(query string) []PortRow {
-	var portRows []PortRow
+// StreamLimiter caps the ?stream connections a client keeps open at once
+type StreamLimiter struct {
+	mu   sync.Mutex
+	max  int
+	open map[string]int
+}
 
-	rows, err := f.db.Query(query)
-	if err != nil {
-		log.Printf("Unable to connect DB: %s", err)
+func createStreamLimiter(max int) *StreamLimiter {
+	return &StreamLimiter{max: max, open: make(map[string]int)}
+}
 
-	} else {
-		for rows.Next() {
-			portRow := PortRow{}
-			err := rows.Scan(
-				&portRow.Id,
-				&portRow.Sid,
-				&portRow.Time,
-				&portRow.TimeTicks,
-				&portRow.Ipaddress,
-				&portRow.Hostname,
-				&portRow.IfIndex,
-				&portRow.IfName,
-				&portRow.IfAlias,
-				&portRow.IfOperStatus,
-			)
-			if err != nil {
-				log.Fatal(err)
-			}
-			portRows = append(portRows, portRow)
+// Acquire counts a new stream of the client unless it has max of them open
+func (l *StreamLimiter) Acquire(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-		}
+	if l.max > 0 && l.open[client] >= l.max {
+		return false
 	}
-	return portRows
+	l.open[client]++
+	return true
 }
 
-func (f *Flapper) PortFlaps(startTime, endTime time.Time, ipAddress string, ifIndex int) []Flap {
-
-	SQLQuery := fmt.Sprintf(`SELECT id,
- 		sid, 
-		CONVERT_TZ(time, @@session.time_zone, 'UTC'),
-		timeticks,
-		ipaddress, 
-		hostname, 
-		ifIndex, 
-		ifName, 
-		ifAlias, 
-		ifOperStatus
-		FROM ports 
-		WHERE CONVERT_TZ(time, @@session.time_zone, 'UTC') >= '%s' 
-		AND CONVERT_TZ(time, @@session.time_zone, 'UTC') <= '%s' 
-		AND ipaddress = '%s' AND ifIndex = %d
-		AND ifName NOT LIKE '%%.%%'
-		ORDER BY ipaddress, ifIndex, time ASC, timeticks ASC LIMIT 100;`,
-		startTime.Format(timeFormat),
-		endTime.Format(timeFormat),
-		ipAddress,
-		ifIndex,
-	)
+// Release counts a stream of the client as closed
+func (l *StreamLimiter) Release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	var flaps []Flap
-	for _, entry := range f.FetchFromDB(SQLQuery) {
-		flaps = append(flaps, entry.CreateFlap())
+	if l.open[client]--; l.open[client] <= 0 {
+		delete(l.open, client)
 	}
-
-	return flaps
 }
 
-func (f *Flapper) FlapChart(q QueryParams) *FlapsDiagram {
-
-	/*
-		12:00			 13:00
-		3600         1800          0 3600/333=10.81  1800/10.81 = 166
-		 40          20/           0. 40/333=0.12012 20/0.1201 = 166
-		 500	     250          0
-		 [0 0 0 0 1 1 1 0 0 0 1 1 1]
-		333          160          0.  500/333 = 1.5 250 / 1.5 = 166
+// QueryLimiter is a semaphore capping the expensive requests running at once
+type QueryLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
 
-		Cent := intervalSeconds / 333
-		y := flapSecond / Cent
+func createQueryLimiter(max int, wait time.Duration) *QueryLimiter {
+	return &QueryLimiter{slots: make(chan struct{}, max), wait: wait}
+}
 
-	*/
+// Acquire takes a slot, waiting for one to be released for at most wait.
+// It fails when none was or the request was given up.
+func (l *QueryLimiter) Acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
 
-	intervalSeconds := q.End.Unix() - q.Start.Unix()
-	cent := float64(intervalSeconds) / (flapChartWidth - 1)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	timeLine := make([]int, flapChartWidth)
+func (l *QueryLimiter) Release() {
+	<-l.slots
+}
 
-	EnumUnknown := 0
-	EnumUp := 1
-	EnumDown := 2
-	EnumFlappingUp := 3
-	EnumFlappingDown := 4
+// expensiveActions scan the window and are gated by MaxConcurrentQueries.
+// ?stream isn't: it holds its connection for long but its polls are cheap.
+var expensiveActions = map[string]bool{
+	actionReview:     true,
+	actionEvents:     true,
+	actionStats:      true,
+	actionAliasStats: true,
+	actionFlapChart:  true,
+	actionFlapCharts: true,
+}
 
-	flaps := f.PortFlaps(q.Start, q.End, q.Host, q.IfIndex)
+// BLACKLIST
 
-	status := EnumUnknown
+// BlacklistEntry describes known flapping ports. Every field given must match:
+// Host and IfIndex exactly, Alias ignoring case with * standing for any text.
+type BlacklistEntry struct {
+	Host    string
+	IfIndex int
+	Alias   string
+	aliasRe *regexp.Regexp
+}
 
-	for _, flap := range flaps {
+type blacklistFile struct {
+	Port []BlacklistEntry
+}
 
-		if status == EnumUnknown {
-			if flap.IfOperStatus == ifStatusUpCaption {
-				status = EnumDown
-			} else {
-				status = EnumUp
-			}
-		}
+// Blacklist marks ports in the review that are known to flap
+type Blacklist struct {
+	mu         sync.RWMutex
+	entries    []BlacklistEntry
+	generation uint64 // bumped on every Load
+}
 
-		secondsFromStart := flap.Time.Unix() - q.Start.Unix()
-		floatX := float64(secondsFromStart) / cent
-		x := int(floatX)
+var blacklist = &Blacklist{}
 
-		val := timeLine[x]
-		if val == EnumUnknown {
-			if flap.IfOperStatus == ifStatusUpCaption {
-				timeLine[x] = EnumUp
-			} else {
-				timeLine[x] = EnumDown
-			}
-		} else {
-			if flap.IfOperStatus == ifStatusUpCaption {
-				timeLine[x] = EnumFlappingUp
-			} else {
-				timeLine[x] = EnumFlappingDown
-			}
+func readBlacklistFile(filename string) ([]BlacklistEntry, error) {
+	file := blacklistFile{}
+	meta, err := toml.DecodeFile(filename, &file)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown key %s", undecoded[0])
+	}
 
+	for i := range file.Port {
+		entry := &file.Port[i]
+		if entry.Host == "" && entry.IfIndex == 0 && entry.Alias == "" {
+			return nil, fmt.Errorf("port %d has no Host, IfIndex or Alias", i+1)
+		}
+		entry.Host = normalizeIP(entry.Host)
+		if entry.Alias != "" {
+			pattern := strings.ReplaceAll(regexp.QuoteMeta(entry.Alias), `\*`, ".*")
+			entry.aliasRe = regexp.MustCompile("(?i)^" + pattern + "$")
 		}
 	}
+	return file.Port, nil
+}
 
-	// Fill timeline with colors
-	colorLine := make([]color.RGBA, flapChartWidth)
-
-	for i, enum := range timeLine {
-		switch enum {
-		case EnumUnknown:
-			if status == EnumUp {
-				colorLine[i] = ColorUpState
-			} else if status == EnumDown {
-				colorLine[i] = ColorDownState
-			} else {
-				colorLine[i] = ColorUnknown
-			}
-
-		case EnumUp:
-			colorLine[i] = ColorUp
-			status = EnumUp
+// Load replaces the blacklist with the entries of a file
+func (b *Blacklist) Load(filename string) error {
+	entries, err := readBlacklistFile(filename)
+	if err != nil {
+		return err
+	}
 
-		case EnumDown:
-			colorLine[i] = ColorDown
-			status = EnumDown
+	b.mu.Lock()
+	b.entries = entries
+	b.generation++
+	b.mu.Unlock()
+	return nil
+}
 
-		case EnumFlappingUp:
-			colorLine[i] = ColorFlapping
-			status = EnumUp
+// Generation changes whenever the entries are reloaded
+func (b *Blacklist) Generation() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.generation
+}
 
-		case EnumFlappingDown:
-			colorLine[i] = ColorFlapping
-			status = EnumDown
+func (b *Blacklist) Match(r PortRow) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
+	for _, entry := range b.entries {
+		if entry.matches(r) {
+			return true
 		}
 	}
+	return false
+}
 
-	flapsDiagram := CreateFlapsDiagram()
-
-	for x, currentColor := range colorLine {
-		flapsDiagram.drawCol(x, currentColor)
+func (e BlacklistEntry) matches(r PortRow) bool {
+	if e.Host != "" && e.Host != r.Ipaddress {
+		return false
 	}
-	return flapsDiagram
+	if e.IfIndex != 0 && e.IfIndex != r.IfIndex {
+		return false
+	}
+	if e.aliasRe != nil && (r.IfAlias == nil || !e.aliasRe.MatchString(*r.IfAlias)) {
+		return false
+	}
+	return true
 }
 
-// SERVER
+// MUTE WINDOWS
 
-type Server struct {
-	flapper *Flapper
+// MuteWindow is a recurring time of day, e.g. a nightly maintenance, when flaps are expected.
+// Days are weekday names like "Mon", all days if none given. End may be past midnight.
+type MuteWindow struct {
+	Days  []string
+	Start string // 15:04
+	End   string
 }
 
-func (s Server) Index(response http.ResponseWriter) {
-	message := "FlapMyPort API is ready"
-	response.Write([]byte(message))
+// MuteSchedule tells whether a flap happened in one of the mute windows
+type MuteSchedule struct {
+	location *time.Location
+	periods  []mutePeriod
 }
 
-func (s Server) http400(response http.ResponseWriter, message string) {
+// mutePeriod is a parsed MuteWindow, clock times in minutes since midnight
+type mutePeriod struct {
+	days       [7]bool
+	start, end int
+}
 
-	if message == "" {
-		message = "Bad request"
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
 	}
-	response.WriteHeader(http.StatusBadRequest)
-	response.Write([]byte(message))
+	return t.Hour()*60 + t.Minute(), nil
 }
 
-func (s *Server) HandleReview(response http.ResponseWriter, request *http.Request, q QueryParams) {
-
-	results, _ := s.flapper.Review(q.Start, q.End, q.Filter)
+func parseWeekday(s string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := day.String()
+		if strings.EqualFold(s, name) || strings.EqualFold(s, name[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
 
-	jsonResults, err := json.Marshal(results)
+func compileMuteSchedule(zone string, windows []MuteWindow) (*MuteSchedule, error) {
+	location, err := time.LoadLocation(zone)
 	if err != nil {
-		log.Printf("%s error: %s", request.URL, err)
-		response.WriteHeader(http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("invalid MuteTimeZone %q", zone)
 	}
-	response.Header().Add("Content-Type", "application/json")
-	response.Write(jsonResults)
 
+	schedule := &MuteSchedule{location: location}
+	for _, window := range windows {
+		period := mutePeriod{}
+		if period.start, err = parseClock(window.Start); err != nil {
+			return nil, err
+		}
+		if period.end, err = parseClock(window.End); err != nil {
+			return nil, err
+		}
+		if period.start == period.end {
+			return nil, fmt.Errorf("window %s-%s is empty", window.Start, window.End)
+		}
+
+		for _, name := range window.Days {
+			day, err := parseWeekday(name)
+			if err != nil {
+				return nil, err
+			}
+			period.days[day] = true
+		}
+		if len(window.Days) == 0 {
+			period.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		schedule.periods = append(schedule.periods, period)
+	}
+	return schedule, nil
 }
 
-func (s *Server) HandleCheck(response http.ResponseWriter, request *http.Request) {
-	logVerbose(fmt.Sprintln("?check requested"))
+// Muted reports a time inside a mute window.
+// A window past midnight belongs to the day it starts on.
+func (m *MuteSchedule) Muted(t time.Time) bool {
+	if m == nil || len(m.periods) == 0 {
+		return false
+	}
 
-	result := CheckResult{CheckResult: "flapmyport"}
+	t = t.In(m.location)
+	minute := t.Hour()*60 + t.Minute()
+	day, yesterday := t.Weekday(), (t.Weekday()+6)%7
 
-	jsonResult, err := json.Marshal(result)
-	if err != nil {
-		log.Printf("%s error: %s", request.URL, err)
-		response.WriteHeader(http.StatusInternalServerError)
-		return
+	for _, period := range m.periods {
+		if period.start < period.end {
+			if period.days[day] && minute >= period.start && minute < period.end {
+				return true
+			}
+			continue
+		}
+		if period.days[day] && minute >= period.start || period.days[yesterday] && minute < period.end {
+			return true
+		}
 	}
-	response.Write(jsonResult)
+	return false
 }
 
-func (s *Server) HandleFlapChart(response http.ResponseWriter, request *http.Request, q QueryParams) {
-
-	queryParams, err := s.ParseQueryParams(request)
-	if err != nil {
-		log.Printf("%s error: %s", request.URL, err)
-		return
-	}
+// DIALECTS
+
+// Dialect hides the SQL differences between supported databases
+type Dialect interface {
+	// Driver is the database/sql driver name
+	Driver() string
+	// UTC converts a time column to UTC
+	UTC(column string) string
+	// Rebind rewrites ? placeholders to the database's syntax
+	Rebind(query string) string
+	// TruncTime truncates a time expression to an hour or a day, formatted as timeFormat text
+	TruncTime(expr string, bucket string) string
+	// Like matches a column against a ? pattern ignoring case, \ escapes the wildcards
+	Like(column string) string
+	// Equal compares a column to ? ignoring case
+	Equal(column string) string
+}
 
-	if queryParams.Host == "" {
-		msg := fmt.Sprintf("%s not given", getParamHost)
-		log.Printf("%s error: %s", request.URL, msg)
-		s.http400(response, msg)
-		return
-	}
-	if queryParams.IfIndex == 0 {
-		msg := fmt.Sprintf("%s not given", getParamIfIndex)
-		log.Printf("%s error: %s", request.URL, msg)
-		s.http400(response, msg)
-		return
-	}
+var dialects = map[string]Dialect{
+	driverMySQL:    mysqlDialect{},
+	driverPostgres: postgresDialect{},
+}
 
-	flapChart := s.flapper.FlapChart(queryParams)
+// dbSetup is implemented by dialects of databases the API creates itself
+type dbSetup interface {
+	Setup(db *sql.DB, c Config) error
+}
 
-	png.Encode(response, flapChart.img)
+// dbConfigure is implemented by dialects preparing the driver before the DSN is opened
+type dbConfigure interface {
+	Configure(c Config) error
 }
 
-func (s *Server) ParseQueryParams(request *http.Request) (QueryParams, error) {
+// snmpflapd stores times in the session time zone
+type mysqlDialect struct{}
 
-	queryParams := QueryParams{
-		Start: time.Now().UTC().Add(-defaultReviewInterval),
-		End:   time.Now().UTC(),
-		Filter: Filter{
-			Conditions: []string{},
-		},
-	}
+func (mysqlDialect) Driver() string {
+	return "mysql"
+}
 
-	query := request.URL.Query()
+func (mysqlDialect) UTC(column string) string {
+	return fmt.Sprintf("CONVERT_TZ(%s, @@session.time_zone, 'UTC')", column)
+}
 
-	if _, ok := query[actionCheck]; ok {
-		queryParams.action = actionCheck
-	}
+func (mysqlDialect) Rebind(query string) string {
+	return query
+}
 
-	if _, ok := query[actionReview]; ok {
-		queryParams.action = actionReview
+func (mysqlDialect) TruncTime(expr string, bucket string) string {
+	if bucket == statsBucketDay {
+		return fmt.Sprintf("DATE_FORMAT(%s, '%%Y-%%m-%%d 00:00:00')", expr)
 	}
+	return fmt.Sprintf("DATE_FORMAT(%s, '%%Y-%%m-%%d %%H:00:00')", expr)
+}
 
-	if _, ok := query[actionFlapHistory]; ok {
-		queryParams.action = actionFlapHistory
-	}
+// The default collations ignore case
+func (mysqlDialect) Like(column string) string {
+	return column + " LIKE ?"
+}
 
-	if _, ok := query[actionFlapChart]; ok {
-		queryParams.action = actionFlapChart
-	}
+func (mysqlDialect) Equal(column string) string {
+	return column + " = ?"
+}
 
-	if ifIndexStr, ok := query[getParamIfIndex]; ok {
-		queryParams.IfIndex, _ = strconv.Atoi(ifIndexStr[0])
+// Configure registers the TLS config the DSN refers to when certificates are given
+func (mysqlDialect) Configure(c Config) error {
+	if !c.mysqlCustomTLS() {
+		return nil
 	}
 
-	if host, ok := query[getParamHost]; ok {
-		queryParams.Host = host[0]
+	serverName := c.DBHost
+	if host, _, err := net.SplitHostPort(c.DBHost); err == nil {
+		serverName = host
 	}
+	tlsConfig := &tls.Config{ServerName: serverName}
 
-	if startStr, ok := query[getParamStartTime]; ok {
-		if startStr[0] != "" {
-			if start, err := time.Parse(timeFormat, startStr[0]); err != nil {
-				log.Printf("%s invalid start time: %s", request.URL, err)
-				return queryParams, err
-			} else {
-				queryParams.Start = start
-			}
+	if c.DBTLSCA != "" {
+		pem, err := os.ReadFile(c.DBTLSCA)
+		if err != nil {
+			return err
 		}
-	}
-
-	if endStr, ok := query[getParamEndTime]; ok {
-		if endStr[0] != "" {
-			if end, err := time.Parse(timeFormat, endStr[0]); err != nil {
-				log.Printf("%s invalid end time: %s", request.URL, err)
-				return queryParams, err
-			} else {
-				queryParams.End = end
-			}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", c.DBTLSCA)
 		}
 	}
 
-	// `start` and `end` are overwritten if `interval` is provided
-	if intervalStr, ok := query[getParamInterval]; ok {
-		interval, err := strconv.Atoi(intervalStr[0])
-		if err == nil {
-			duration := time.Duration(interval) * time.Second
-			queryParams.End = time.Now().UTC()
-			queryParams.Start = queryParams.End.Add(-duration)
+	if c.DBTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.DBTLSCert, c.DBTLSKey)
+		if err != nil {
+			return err
 		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	queryParams.Filter.ParseFilter(request.URL.Query())
+	return mysql.RegisterTLSConfig(mysqlTLSConfigName, tlsConfig)
+}
 
-	return queryParams, nil
+// The time column is expected to be timestamp with time zone
+type postgresDialect struct{}
+
+func (postgresDialect) Driver() string {
+	return "postgres"
 }
 
-func (s *Server) route(response http.ResponseWriter, request *http.Request) {
+func (postgresDialect) UTC(column string) string {
+	return fmt.Sprintf("(%s AT TIME ZONE 'UTC')", column)
+}
 
-	queryParams, err := s.ParseQueryParams(request)
-	if err != nil {
-		log.Printf("%s ParseQueryParams error: %s", request.URL, err)
-		s.http400(response, err.Error())
-		return
+func (postgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
 	}
+	return b.String()
+}
 
-	logVerbose(fmt.Sprintf("/%s requested", queryParams.action))
+func (postgresDialect) TruncTime(expr string, bucket string) string {
+	return fmt.Sprintf("to_char(date_trunc('%s', %s), 'YYYY-MM-DD HH24:MI:SS')", bucket, expr)
+}
 
-	switch queryParams.action {
+// LIKE and = are case-sensitive in PostgreSQL
+func (postgresDialect) Like(column string) string {
+	return column + " ILIKE ?"
+}
 
-	case actionReview:
-		s.HandleReview(response, request, queryParams)
+func (postgresDialect) Equal(column string) string {
+	return "LOWER(" + column + ") = LOWER(?)"
+}
 
-	case actionFlapChart:
-		s.HandleFlapChart(response, request, queryParams)
+// FLAPPER
 
-	case actionCheck:
-		s.HandleCheck(response, request)
+// Store is a database of flaps the reviews and port histories are read from.
+// Flapper is the implementation on SQL databases, MySQL, PostgreSQL and SQLite
+// differ in their Dialect only.
+type Store interface {
+	Review(ctx context.Context, q QueryParams) (ReviewResult, error)
+	PortFlaps(ctx context.Context, q QueryParams, afterID int, limit int) ([]Flap, error)
+}
 
-	default:
-		s.Index(response)
-	}
+var sqlIdentifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 
+type Flapper struct {
+	db              *sql.DB
+	dialect         Dialect
+	table           string
+	columns         ColumnsConfig
+	palette         Palette
+	ifNameExclusion SQLCondition
+	extendedColumns bool
+	queryTimeout    time.Duration
+	flapThreshold   int
+	recentlyActive  time.Duration // see Config.RecentlyActiveSec
+	minTransitions  int
+	coverageScope   string
+	dominantColumns bool // see chartColumnStateDominant
+	muteSchedule    *MuteSchedule
+	// Since when the pings of keepAlive fail, zero while the database answers
+	unreachableMu    sync.Mutex
+	unreachableSince time.Time
+	// fetchRows runs a query selecting portColumns, FetchFromDB unless rows are fed
+	// from elsewhere, e.g. canned ones checking the review without a database
+	fetchRows func(ctx context.Context, query string, args ...interface{}) ([]PortRow, error)
+	// store serves the reviews and port flaps, the Flapper itself unless
+	// they come from another Store
+	store Store
 }
 
-func readConfigFile(file *string) {
-	if _, err := toml.DecodeFile(*file, &config); err != nil {
-		msg := fmt.Sprintf("%s not found. Suppose we're using environment variables", *file)
-		fmt.Println(msg)
-		log.Println(msg)
+func createFlapper(c Config) (*Flapper, error) {
+	palette, err := c.Colors.Palette()
+	if err != nil {
+		return nil, fmt.Errorf("invalid chart color: %s", err)
 	}
-}
-
-func readConfigEnv() {
 
-	if logFilename, exists := os.LookupEnv("LOGFILE"); exists {
-		config.LogFilename = logFilename
+	// The table name can't be a bound parameter, so it must be a plain identifier
+	if !sqlIdentifierRe.MatchString(c.DBTable) {
+		return nil, fmt.Errorf("invalid DBTable %q", c.DBTable)
+	}
+	if err := c.Columns.Validate(); err != nil {
+		return nil, err
 	}
 
-	if listenAddress, exists := os.LookupEnv("LISTEN_ADDRESS"); exists {
-		config.ListenAddress = listenAddress
+	muteSchedule, err := compileMuteSchedule(c.MuteTimeZone, c.MuteWindows)
+	if err != nil {
+		return nil, err
 	}
 
-	if listenPort, exists := os.LookupEnv("LISTEN_PORT"); exists {
-		if intPort, error := strconv.Atoi(listenPort); error != nil {
-			msg := "Wrong environment variable LISTEN_PORT"
-			fmt.Println(msg)
-			log.Fatalln(msg)
+	dialect, ok := dialects[c.DBDriver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DBDriver %q", c.DBDriver)
+	}
 
-		} else {
-			config.ListenPort = intPort
+	if c.DBPasswordFile != "" {
+		if c.DBPassword, err = readPasswordFile(c.DBPasswordFile); err != nil {
+			return nil, fmt.Errorf("DBPasswordFile: %s", err)
 		}
-
 	}
 
-	if dbHost, exists := os.LookupEnv("DBHOST"); exists {
-		config.DBHost = dbHost
+	if configure, ok := dialect.(dbConfigure); ok {
+		if err := configure.Configure(c); err != nil {
+			return nil, err
+		}
 	}
 
-	if dbName, exists := os.LookupEnv("DBNAME"); exists {
-		config.DBName = dbName
+	db, err := sql.Open(dialect.Driver(), c.SqlDSN())
+	if err != nil {
+		return nil, err
 	}
 
-	if dbUser, exists := os.LookupEnv("DBUSER"); exists {
-		config.DBUser = dbUser
+	// Close idle connections before a firewall silently drops them
+	db.SetConnMaxIdleTime(time.Duration(c.DBConnMaxIdleSec) * time.Second)
+
+	if setup, ok := dialect.(dbSetup); ok {
+		if err := setup.Setup(db, c); err != nil {
+			return nil, err
+		}
 	}
 
-	if dbPassword, exists := os.LookupEnv("DBPASSWORD"); exists {
-		config.DBPassword = dbPassword
+	f := &Flapper{
+		db:              db,
+		dialect:         dialect,
+		table:           c.DBTable,
+		columns:         c.Columns,
+		palette:         palette,
+		ifNameExclusion: compileIfNameExclusion(c.Columns.IfName, c.ExcludeIfNames, dialect),
+		extendedColumns: c.DBExtendedColumns,
+		queryTimeout:    time.Duration(c.QueryTimeoutSec) * time.Second,
+		flapThreshold:   c.FlapThreshold,
+		recentlyActive:  time.Duration(c.RecentlyActiveSec) * time.Second,
+		minTransitions:  c.MinTransitions,
+		coverageScope:   c.CoverageScope,
+		dominantColumns: c.ChartColumnState == chartColumnStateDominant,
+		muteSchedule:    muteSchedule,
 	}
+	f.fetchRows = f.FetchFromDB
+	f.store = f
+	return f, nil
+
 }
 
-func logVerbose(s string) {
-	if flagVerbose {
-		log.Print(s)
+// CheckTable warns about a ports table that is missing or has no rows yet.
+// The database may come up later, so nothing here is fatal.
+func (f *Flapper) CheckTable(ctx context.Context) {
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	SQLQuery := fmt.Sprintf("SELECT %s FROM %s LIMIT 1;", f.columns.Id, f.table)
+	var id int
+	err := f.db.QueryRowContext(ctx, f.dialect.Rebind(SQLQuery)).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		logf(levelWarn, "Table %s is empty", f.table)
+	case isConnError(err):
+		logf(levelWarn, "Unable to connect DB: %s", err)
+	case err != nil:
+		logf(levelWarn, "Unable to read table %s: %s", f.table, err)
+	}
+}
+
+func isIPv6(s string) bool {
+	return strings.Contains(s, ":") && net.ParseIP(s) != nil
+}
+
+// normalizeIP rewrites an IPv6 address in its canonical form, anything else is kept as is
+func normalizeIP(s string) string {
+	if !isIPv6(s) {
+		return s
+	}
+	return net.ParseIP(s).String()
+}
+
+// SQLCondition is a piece of a WHERE clause together with its arguments
+type SQLCondition struct {
+	SQL  string
+	Args []interface{}
+}
+
+// compileIfNameExclusion builds the condition hiding pseudo-interfaces
+// whose ifName column matches any of the LIKE patterns
+func compileIfNameExclusion(column string, patterns []string, dialect Dialect) SQLCondition {
+	condition := SQLCondition{}
+	for _, pattern := range patterns {
+		condition.SQL += " AND NOT (" + dialect.Like(column) + ")"
+		condition.Args = append(condition.Args, pattern)
+	}
+	return condition
+}
+
+// ifNameExclusionFor returns the pseudo-interface condition unless a query asks for them
+func (f *Flapper) ifNameExclusionFor(q QueryParams) SQLCondition {
+	if q.IncludeSubIf {
+		return SQLCondition{}
+	}
+	return f.ifNameExclusion
+}
+
+type Filter struct {
+	Conditions []string
+	Args       []interface{}
+	// Keywords matched against fetched rows, each one must match
+	rowKeywords []filterToken
+	// Keywords matched against fetched rows, one of them must match
+	anyRowKeywords []filterToken
+}
+
+// Columns a filter keyword is matched against when no scope is given
+var filterDefaultColumns = []string{"hostname", "ipaddress", "ifAlias"}
+
+// Filter keyword scopes restricting the match to a single column
+var filterScopes = map[string]string{
+	"host":   "hostname",
+	"ip":     "ipaddress",
+	"alias":  "ifAlias",
+	"ifname": "ifName",
+}
+
+// filterToken is a single parsed filter keyword:
+//
+//	[!][scope:][=]value
+//
+// where ! negates the match, scope is one of filterScopes
+// and = requires an exact match instead of a substring one.
+// The net: scope takes a subnet in CIDR notation instead.
+type filterToken struct {
+	negate  bool
+	exact   bool
+	columns []string
+	value   string
+	subnet  *net.IPNet
+}
+
+func parseFilterToken(kw string) (filterToken, bool, error) {
+	token := filterToken{columns: filterDefaultColumns}
+
+	if strings.HasPrefix(kw, "!") {
+		token.negate = true
+		kw = kw[1:]
+	}
+
+	if strings.HasPrefix(strings.ToLower(kw), "net:") {
+		_, subnet, err := net.ParseCIDR(kw[4:])
+		if err != nil {
+			return token, false, fmt.Errorf("invalid subnet %q", kw[4:])
+		}
+		token.columns = []string{"ipaddress"}
+		token.value = kw[4:]
+		token.subnet = subnet
+		return token, true, nil
+	}
+
+	// Unknown scopes are kept as part of the value, IPv6 addresses contain colons too
+	if i := strings.Index(kw, ":"); i > 0 {
+		if column, ok := filterScopes[strings.ToLower(kw[:i])]; ok {
+			token.columns = []string{column}
+			kw = kw[i+1:]
+		}
+	}
+
+	if strings.HasPrefix(kw, "=") {
+		token.exact = true
+		kw = kw[1:]
+	}
+
+	token.value = kw
+	return token, kw != "", nil
+}
+
+// inSQL tells keywords SQL can evaluate from the ones matched against fetched rows.
+// IPv6 addresses have many spellings, so they are compared in their canonical form,
+// and a LIKE can't tell whether an address belongs to a subnet.
+func (t filterToken) inSQL() bool {
+	if t.subnet != nil {
+		return false
+	}
+	if !isIPv6(t.value) {
+		return true
+	}
+	for _, column := range t.columns {
+		if column == "ipaddress" {
+			return false
+		}
+	}
+	return true
+}
+
+// String identifies the keyword in cache keys
+func (t filterToken) String() string {
+	subnet := ""
+	if t.subnet != nil {
+		subnet = t.subnet.String()
+	}
+	return fmt.Sprintf("%t:%t:%s:%q:%s", t.negate, t.exact, strings.Join(t.columns, ","), t.value, subnet)
+}
+
+// matches evaluates a keyword against a row the way condition() does in SQL,
+// ignoring negation
+func (t filterToken) matches(row PortRow) bool {
+	if t.subnet != nil {
+		ip := net.ParseIP(row.Ipaddress)
+		return ip != nil && t.subnet.Contains(ip)
+	}
+
+	for _, column := range t.columns {
+		var value string
+		switch column {
+		case "hostname":
+			if row.Hostname != nil {
+				value = *row.Hostname
+			}
+		case "ipaddress":
+			value = row.Ipaddress
+		case "ifAlias":
+			if row.IfAlias != nil {
+				value = *row.IfAlias
+			}
+		case "ifName":
+			if row.IfName != nil {
+				value = *row.IfName
+			}
+		}
+
+		needle := strings.ToLower(t.value)
+		if column == "ipaddress" {
+			value, needle = normalizeIP(value), normalizeIP(t.value)
+		} else {
+			value = strings.ToLower(value)
+		}
+
+		if t.exact && value == needle || !t.exact && strings.Contains(value, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// condition returns a parenthesized SQL condition with its arguments
+func (t filterToken) condition(columns ColumnsConfig, dialect Dialect) (string, []interface{}) {
+	compare, joiner := dialect.Like, " OR "
+	if t.exact {
+		compare = dialect.Equal
+	}
+	if t.negate {
+		joiner = " AND "
+	}
+
+	arg := t.value
+	if !t.exact {
+		arg = "%" + escapeLike(t.value) + "%"
+	}
+
+	parts := make([]string, 0, len(t.columns))
+	args := make([]interface{}, 0, len(t.columns))
+	for _, column := range t.columns {
+		part := compare(columns.Column(column))
+		if t.negate {
+			part = "NOT (" + part + ")"
+		}
+		parts = append(parts, part)
+		args = append(args, arg)
+	}
+	return "(" + strings.Join(parts, joiner) + ")", args
+}
+
+// escapeLike makes LIKE wildcards in s match literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// splitKeywords splits a filter on whitespace keeping "quoted phrases" together.
+// Quotes may follow a ! or a scope, e.g. !"lab switch" or alias:"core uplink".
+// An unterminated quote extends to the end of the string.
+func splitKeywords(s string) []string {
+	var keywords []string
+	var keyword strings.Builder
+	inQuotes, inKeyword := false, false
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inKeyword = true
+
+		case unicode.IsSpace(r) && !inQuotes:
+			if inKeyword {
+				keywords = append(keywords, keyword.String())
+				keyword.Reset()
+				inKeyword = false
+			}
+
+		default:
+			keyword.WriteRune(r)
+			inKeyword = true
+		}
+	}
+
+	if inKeyword {
+		keywords = append(keywords, keyword.String())
+	}
+	return keywords
+}
+
+// ParseFilter turns the filter keywords into SQL conditions.
+// Keywords prefixed with ! are exclusions and always apply.
+// The rest must all match, or at least one with filtermode=any.
+func (f *Filter) ParseFilter(v url.Values, columns ColumnsConfig, dialect Dialect) error {
+	filter, ok := v[getParamFilter]
+	if !ok {
+		return nil
+	}
+
+	mode := filterModeAll
+	if modeStr, ok := v[getParamFilterMode]; ok && modeStr[0] != "" {
+		mode = modeStr[0]
+	}
+	if mode != filterModeAll && mode != filterModeAny {
+		return fmt.Errorf("invalid %s %q", getParamFilterMode, mode)
+	}
+
+	var positives []filterToken
+	var matches []string
+	var matchArgs []interface{}
+	rowMatchesOnly := false
+
+	keywords := splitKeywords(filter[0])
+	for _, kw := range keywords {
+		token, ok, err := parseFilterToken(kw)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if !token.negate {
+			positives = append(positives, token)
+		}
+
+		if !token.inSQL() {
+			if token.negate {
+				f.rowKeywords = append(f.rowKeywords, token)
+			} else {
+				rowMatchesOnly = true
+			}
+			continue
+		}
+
+		condition, args := token.condition(columns, dialect)
+		if token.negate {
+			f.Conditions = append(f.Conditions, "AND "+condition)
+			f.Args = append(f.Args, args...)
+		} else {
+			matches = append(matches, condition)
+			matchArgs = append(matchArgs, args...)
+		}
+	}
+
+	if len(positives) == 0 {
+		return nil
+	}
+
+	if mode == filterModeAny {
+		// SQL can't OR with a keyword it doesn't evaluate, so all of them are matched in Go
+		if rowMatchesOnly {
+			f.anyRowKeywords = positives
+			return nil
+		}
+		f.Conditions = append(f.Conditions, fmt.Sprintf("AND (%s)", strings.Join(matches, " OR ")))
+	} else {
+		for _, match := range matches {
+			f.Conditions = append(f.Conditions, "AND "+match)
+		}
+		for _, token := range positives {
+			if !token.inSQL() {
+				f.rowKeywords = append(f.rowKeywords, token)
+			}
+		}
+	}
+	f.Args = append(f.Args, matchArgs...)
+	return nil
+}
+
+// Require adds a keyword every row must match
+func (f *Filter) Require(token filterToken, columns ColumnsConfig, dialect Dialect) {
+	if !token.inSQL() {
+		f.rowKeywords = append(f.rowKeywords, token)
+		return
+	}
+	condition, args := token.condition(columns, dialect)
+	f.Conditions = append(f.Conditions, "AND "+condition)
+	f.Args = append(f.Args, args...)
+}
+
+// HasRowKeywords tells whether some keywords are only matched against fetched rows
+func (f *Filter) HasRowKeywords() bool {
+	return len(f.rowKeywords) > 0 || len(f.anyRowKeywords) > 0
+}
+
+// Match checks a fetched row against the keywords SQL couldn't evaluate
+func (f *Filter) Match(row PortRow) bool {
+	for _, token := range f.rowKeywords {
+		if token.matches(row) == token.negate {
+			return false
+		}
+	}
+
+	if len(f.anyRowKeywords) == 0 {
+		return true
+	}
+	for _, token := range f.anyRowKeywords {
+		if token.matches(row) {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewCondition selects the rows in the window of q passing its filter.
+// Keywords SQL can't evaluate are left to q.Filter.Match.
+func (f *Flapper) reviewCondition(q QueryParams) SQLCondition {
+	exclusion := f.ifNameExclusionFor(q)
+
+	condition := SQLCondition{
+		SQL:  f.windowCondition() + " " + exclusion.SQL,
+		Args: []interface{}{q.Start.Format(timeFormat), q.End.Format(timeFormat)},
+	}
+	condition.Args = append(condition.Args, exclusion.Args...)
+
+	if q.AfterID > 0 {
+		condition.SQL += " AND " + f.columns.Id + " > ?"
+		condition.Args = append(condition.Args, q.AfterID)
+	}
+
+	condition.SQL += " " + strings.Join(q.Filter.Conditions, " ")
+	condition.Args = append(condition.Args, q.Filter.Args...)
+	return condition
+}
+
+// windowMaxID returns the newest flap id in the window of q
+func (f *Flapper) windowMaxID(ctx context.Context, q QueryParams) (int, error) {
+	exclusion := f.ifNameExclusionFor(q)
+
+	SQLQuery := fmt.Sprintf(`SELECT COALESCE(MAX(%s), 0)
+		FROM %s
+		WHERE %s
+		%s;`,
+		f.columns.Id,
+		f.table,
+		f.windowCondition(),
+		exclusion.SQL,
+	)
+
+	args := []interface{}{q.Start.Format(timeFormat), q.End.Format(timeFormat)}
+	args = append(args, exclusion.Args...)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	var id int
+	err := f.db.QueryRowContext(ctx, f.dialect.Rebind(SQLQuery), args...).Scan(&id)
+	if err != nil && ctx.Err() != nil {
+		return id, ctx.Err()
+	}
+	return id, err
+}
+
+// RecentFlap is a flap together with the port it happened on
+type RecentFlap struct {
+	Flap
+	Hostname  string `json:"hostname"`
+	Ipaddress string `json:"ipaddress"`
+	IfIndex   int    `json:"ifIndex"`
+	IfName    string `json:"ifName"`
+	IfAlias   string `json:"ifAlias"`
+}
+
+// RecentFlaps returns the newest count flaps of the whole table, newest first
+func (f *Flapper) RecentFlaps(ctx context.Context, q QueryParams, count int) ([]RecentFlap, error) {
+	exclusion := f.ifNameExclusionFor(q)
+
+	// Ordered by the raw column to use its index, flaps within the repeated hour
+	// at the end of DST may come out of order
+	SQLQuery := fmt.Sprintf(`SELECT %s
+		FROM %s
+		WHERE 1 = 1
+		%s
+		ORDER BY %s DESC, %s DESC LIMIT %d;`,
+		f.portColumns(),
+		f.table,
+		exclusion.SQL,
+		f.columns.Time,
+		f.columns.TimeTicks,
+		count,
+	)
+
+	portRows, err := f.fetchRows(ctx, SQLQuery, exclusion.Args...)
+	if err != nil {
+		return nil, err
+	}
+
+	flaps := make([]RecentFlap, 0, len(portRows))
+	for _, portRow := range portRows {
+		if !q.IncludeSid {
+			portRow.Sid = ""
+		}
+		port := PortView{}
+		port.FromDB(portRow)
+
+		flap := RecentFlap{
+			Flap:      portRow.CreateFlap(),
+			Ipaddress: portRow.Ipaddress,
+			IfIndex:   port.IfIndex,
+			IfName:    port.IfName,
+			IfAlias:   port.IfAlias,
+		}
+		if portRow.Hostname != nil {
+			flap.Hostname = *portRow.Hostname
+		}
+		flaps = append(flaps, flap)
+	}
+	return flaps, nil
+}
+
+// HealthStatus is the answer to ?status
+type HealthStatus struct {
+	DB          string `json:"db"`
+	DBLatencyMs int64  `json:"dbLatencyMs"`
+	// Age of the newest flap in the table, omitted when there are none
+	NewestFlapAge  string    `json:"newestFlapAge,omitempty"`
+	NewestFlapTime *JSONTime `json:"newestFlapTime,omitempty"`
+	CollectorStale bool      `json:"collectorStale"`
+	// Since when the background pings of DBKeepaliveSec fail
+	DBUnreachableSince *JSONTime `json:"dbUnreachableSince,omitempty"`
+}
+
+// Ping checks that the database answers within QueryTimeoutSec
+func (f *Flapper) Ping(ctx context.Context) error {
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+	return f.db.PingContext(ctx)
+}
+
+// keepAlive pings the database every interval until stop is closed. It keeps a pooled
+// connection from being dropped by a firewall and notices an outage before a request does.
+func (f *Flapper) keepAlive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := f.Ping(context.Background())
+
+		f.unreachableMu.Lock()
+		if err != nil && f.unreachableSince.IsZero() {
+			f.unreachableSince = time.Now()
+			logf(levelWarn, "Database doesn't answer keepalive pings: %s", err)
+		} else if err == nil && !f.unreachableSince.IsZero() {
+			f.unreachableSince = time.Time{}
+			logf(levelInfo, "Database answers keepalive pings again")
+		}
+		f.unreachableMu.Unlock()
+	}
+}
+
+// Health pings the database and finds the newest flap written by the collector
+func (f *Flapper) Health(ctx context.Context, staleAfter time.Duration) (HealthStatus, error) {
+	status := HealthStatus{DB: "unreachable"}
+
+	f.unreachableMu.Lock()
+	if !f.unreachableSince.IsZero() {
+		status.DBUnreachableSince = jsonTime(f.unreachableSince)
+	}
+	f.unreachableMu.Unlock()
+
+	started := time.Now()
+	if err := f.Ping(ctx); err != nil {
+		return status, err
+	}
+	status.DB = "ok"
+	status.DBLatencyMs = time.Since(started).Milliseconds()
+
+	flaps, err := f.RecentFlaps(ctx, QueryParams{IncludeSubIf: true}, 1)
+	if err != nil || len(flaps) == 0 {
+		return status, err
+	}
+
+	newest := flaps[0].Time
+	age := time.Since(newest.Time)
+	status.NewestFlapTime = &newest
+	status.NewestFlapAge = age.Round(time.Second).String()
+	status.CollectorStale = staleAfter > 0 && age > staleAfter
+	return status, nil
+}
+
+// HostEntry is a host seen in the window
+type HostEntry struct {
+	Name      string `json:"name"`
+	Ipaddress string `json:"ipaddress"`
+}
+
+// Hosts lists the hosts having flaps in the window of q, ordered by name
+func (f *Flapper) Hosts(ctx context.Context, q QueryParams) ([]HostEntry, error) {
+	condition := f.reviewCondition(q)
+
+	c := f.columns
+	SQLQuery := fmt.Sprintf(`SELECT DISTINCT %[1]s, %[2]s
+		FROM %[3]s
+		WHERE %[4]s
+		ORDER BY %[2]s, %[1]s LIMIT %[5]d;`,
+		c.Ipaddress,
+		c.Hostname,
+		f.table,
+		condition.SQL,
+		sqlRowsLimit,
+	)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, SQLQuery, condition.Args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	hosts := []HostEntry{}
+	seen := map[HostEntry]bool{}
+	for rows.Next() {
+		row := PortRow{}
+		if err := rows.Scan(&row.Ipaddress, &row.Hostname); err != nil {
+			return nil, err
+		}
+		row.Ipaddress = normalizeIP(row.Ipaddress)
+		if !q.Filter.Match(row) {
+			continue
+		}
+
+		host := HostEntry{Ipaddress: row.Ipaddress}
+		if row.Hostname != nil {
+			host.Name = *row.Hostname
+		}
+		// Spellings of an IPv6 address are one host
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// Databases disagree on where NULL names go
+	sort.SliceStable(hosts, func(i, j int) bool {
+		if hosts[i].Name != hosts[j].Name {
+			return hosts[i].Name < hosts[j].Name
+		}
+		return hosts[i].Ipaddress < hosts[j].Ipaddress
+	})
+	return hosts, nil
+}
+
+// InterfaceEntry is a port of a host seen in the window
+type InterfaceEntry struct {
+	IfIndex int    `json:"ifIndex"`
+	IfName  string `json:"ifName"`
+	IfAlias string `json:"ifAlias"`
+}
+
+// Interfaces lists the ports of q.Host having flaps in the window
+func (f *Flapper) Interfaces(ctx context.Context, q QueryParams) ([]InterfaceEntry, error) {
+	exclusion := f.ifNameExclusionFor(q)
+
+	hostCondition, err := f.hostCondition(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	c := f.columns
+	SQLQuery := fmt.Sprintf(`SELECT DISTINCT %[1]s, %[2]s, %[3]s
+		FROM %[4]s
+		WHERE %[5]s
+		AND %[6]s
+		%[7]s
+		ORDER BY %[1]s LIMIT %[8]d;`,
+		c.IfIndex,
+		c.IfName,
+		c.IfAlias,
+		f.table,
+		f.windowCondition(),
+		hostCondition.SQL,
+		exclusion.SQL,
+		sqlRowsLimit,
+	)
+
+	args := []interface{}{q.Start.Format(timeFormat), q.End.Format(timeFormat)}
+	args = append(args, hostCondition.Args...)
+	args = append(args, exclusion.Args...)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, SQLQuery, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	interfaces := []InterfaceEntry{}
+	for rows.Next() {
+		row := PortRow{}
+		if err := rows.Scan(&row.IfIndex, &row.IfName, &row.IfAlias); err != nil {
+			return nil, err
+		}
+
+		port := PortView{}
+		port.FromDB(row)
+		interfaces = append(interfaces, InterfaceEntry{
+			IfIndex: port.IfIndex,
+			IfName:  port.IfName,
+			IfAlias: port.IfAlias,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return interfaces, nil
+}
+
+// StatsBucket is the count of flaps starting at Time and lasting an hour or a day
+type StatsBucket struct {
+	Time  JSONTime `json:"time"`
+	Flaps int      `json:"flaps"`
+}
+
+// StatsTopEntry is a host, or a port when IfIndex is set, with its count of flaps
+type StatsTopEntry struct {
+	Hostname  string `json:"hostname"`
+	Ipaddress string `json:"ipaddress"`
+	IfIndex   *int   `json:"ifIndex,omitempty"`
+	IfName    string `json:"ifName,omitempty"`
+	IfAlias   string `json:"ifAlias,omitempty"`
+	Flaps     int    `json:"flaps"`
+}
+
+// errStatsRowKeywords is returned for filters only matched against fetched rows,
+// the counts are made by the database
+var errStatsRowKeywords = errors.New("IPv6 and net: keywords can't filter stats")
+
+func bucketDuration(bucket string) time.Duration {
+	if bucket == statsBucketDay {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
+// FlapBuckets counts flaps per q.Bucket, buckets without flaps are included with zero
+func (f *Flapper) FlapBuckets(ctx context.Context, q QueryParams) ([]StatsBucket, error) {
+	if q.Filter.HasRowKeywords() {
+		return nil, errStatsRowKeywords
+	}
+	condition := f.reviewCondition(q)
+	bucket := f.dialect.TruncTime(f.dialect.UTC(f.columns.Time), q.Bucket)
+
+	SQLQuery := fmt.Sprintf(`SELECT %[1]s, COUNT(*)
+		FROM %[2]s
+		WHERE %[3]s
+		GROUP BY %[1]s;`,
+		bucket,
+		f.table,
+		condition.SQL,
+	)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, SQLQuery, condition.Args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[time.Time]int{}
+	for rows.Next() {
+		var start string
+		var count int
+		if err := rows.Scan(&start, &count); err != nil {
+			return nil, err
+		}
+		t, err := time.Parse(timeFormat, start)
+		if err != nil {
+			return nil, err
+		}
+		counts[t] = count
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	step := bucketDuration(q.Bucket)
+	buckets := []StatsBucket{}
+	for t := q.Start.UTC().Truncate(step); !t.After(q.End); t = t.Add(step) {
+		buckets = append(buckets, StatsBucket{Time: JSONTime{t}, Flaps: counts[t]})
+	}
+	return buckets, nil
+}
+
+// TopFlapping returns the q.TopN hosts or ports with the most flaps in the window of q
+func (f *Flapper) TopFlapping(ctx context.Context, q QueryParams) ([]StatsTopEntry, error) {
+	if q.Filter.HasRowKeywords() {
+		return nil, errStatsRowKeywords
+	}
+	condition := f.reviewCondition(q)
+
+	c := f.columns
+	columns := fmt.Sprintf("%s, MAX(%s)", c.Ipaddress, c.Hostname)
+	groupBy := c.Ipaddress
+	if q.TopBy == statsTopByPort {
+		columns += fmt.Sprintf(", %s, MAX(%s), MAX(%s)", c.IfIndex, c.IfName, c.IfAlias)
+		groupBy += ", " + c.IfIndex
+	}
+
+	SQLQuery := fmt.Sprintf(`SELECT %s, COUNT(*)
+		FROM %s
+		WHERE %s
+		GROUP BY %s
+		ORDER BY COUNT(*) DESC, %s LIMIT %d;`,
+		columns,
+		f.table,
+		condition.SQL,
+		groupBy,
+		groupBy,
+		q.TopN,
+	)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, SQLQuery, condition.Args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	top := []StatsTopEntry{}
+	for rows.Next() {
+		row := PortRow{}
+		var count int
+		dest := []interface{}{&row.Ipaddress, &row.Hostname}
+		if q.TopBy == statsTopByPort {
+			dest = append(dest, &row.IfIndex, &row.IfName, &row.IfAlias)
+		}
+		if err := rows.Scan(append(dest, &count)...); err != nil {
+			return nil, err
+		}
+
+		entry := StatsTopEntry{Ipaddress: normalizeIP(row.Ipaddress), Flaps: count}
+		if row.Hostname != nil {
+			entry.Hostname = *row.Hostname
+		}
+		if q.TopBy == statsTopByPort {
+			ifIndex := row.IfIndex
+			entry.IfIndex = &ifIndex
+			if row.IfName != nil {
+				entry.IfName = *row.IfName
+			}
+			if row.IfAlias != nil {
+				entry.IfAlias = *row.IfAlias
+			}
+		}
+		top = append(top, entry)
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return top, nil
+}
+
+// AliasStatsEntry is the count of flaps and of distinct ports sharing an ifAlias
+type AliasStatsEntry struct {
+	IfAlias string `json:"ifAlias"`
+	Flaps   int    `json:"flaps"`
+	Ports   int    `json:"ports"`
+}
+
+// AliasStats counts the flaps in the window of q per ifAlias across all hosts, most flaps first.
+// Ports without an alias are left out.
+func (f *Flapper) AliasStats(ctx context.Context, q QueryParams) ([]AliasStatsEntry, error) {
+	if q.Filter.HasRowKeywords() {
+		return nil, errStatsRowKeywords
+	}
+	condition := f.reviewCondition(q)
+
+	c := f.columns
+	SQLQuery := fmt.Sprintf(`SELECT if_alias, SUM(flaps), COUNT(*)
+		FROM (
+			SELECT %[1]s AS if_alias, COUNT(*) AS flaps
+			FROM %[2]s
+			WHERE %[3]s AND %[1]s IS NOT NULL AND %[1]s <> ''
+			GROUP BY %[1]s, %[4]s, %[5]s
+		) ports
+		GROUP BY if_alias
+		ORDER BY SUM(flaps) DESC, if_alias;`,
+		c.IfAlias,
+		f.table,
+		condition.SQL,
+		c.Ipaddress,
+		c.IfIndex,
+	)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, SQLQuery, condition.Args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []AliasStatsEntry{}
+	for rows.Next() {
+		entry := AliasStatsEntry{}
+		if err := rows.Scan(&entry.IfAlias, &entry.Flaps, &entry.Ports); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, entry)
+	}
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return aliases, nil
+}
+
+func (f *Flapper) Review(ctx context.Context, q QueryParams) (ReviewResult, error) {
+
+	startTime, endTime := q.Start, q.End
+	condition := f.reviewCondition(q)
+
+	// Exact addresses of a host picker, unlike a filter matching parts of them
+	if len(q.Hosts) > 0 {
+		hostsCondition, err := f.hostsCondition(ctx, q)
+		if err != nil {
+			return ReviewResult{}, err
+		}
+		condition.SQL += " AND " + hostsCondition.SQL
+		condition.Args = append(condition.Args, hostsCondition.Args...)
+	}
+
+	SQLQuery := fmt.Sprintf(`SELECT %s
+		FROM %s 
+		WHERE %s
+		ORDER BY %s LIMIT %d;`,
+		f.portColumns(),
+		f.table,
+		condition.SQL,
+		f.portOrder(),
+		sqlRowsLimit,
+	)
+	args := condition.Args
+
+	result := ReviewResult{
+		Hosts: make([]Host, 0, 100),
+		Params: Params{
+			TimeStart: jsonTime(startTime),
+			TimeEnd:   jsonTime(endTime),
+		},
+	}
+
+	// Most polls find nothing new, a MAX(id) is much cheaper than the review itself
+	if q.AfterID > 0 {
+		latestFlapID, err := f.windowMaxID(ctx, q)
+		if err != nil {
+			return result, err
+		}
+		result.Params.LatestFlapID = latestFlapID
+		if latestFlapID <= q.AfterID {
+			result.countTotals()
+			return result, nil
+		}
+	}
+
+	portRows, err := f.fetchRows(ctx, SQLQuery, args...)
+	if err != nil {
+		return result, err
+	}
+	if q.Debounce > 0 {
+		portRows = debounce(portRows, q.Debounce)
+	}
+
+	host := &Host{}
+	var coverageStart, coverageEnd *time.Time
+
+	for _, portRow := range portRows {
+
+		if !q.Filter.Match(portRow) {
+			continue
+		}
+		if q.HideBlacklisted && blacklist.Match(portRow) {
+			continue
+		}
+		if f.muteSchedule.Muted(portRow.Time) {
+			continue
+		}
+		if !q.IncludeSid {
+			portRow.Sid = ""
+		}
+
+		// The id range is a high-water mark for clients polling with afterId.
+		// 0 instead of nil if no flaps because clients crashed seeing null :)
+		if result.Params.OldestFlapID == 0 || portRow.Id < result.Params.OldestFlapID {
+			result.Params.OldestFlapID = portRow.Id
+		}
+		if portRow.Id > result.Params.NewestFlapID {
+			result.Params.NewestFlapID = portRow.Id
+		}
+
+		// Rows are ordered by port, not by time
+		flapTime := portRow.Time
+		if result.Params.FirstFlapTime == nil || flapTime.Before(result.Params.FirstFlapTime.Time) {
+			result.Params.FirstFlapTime = jsonTime(flapTime)
+		}
+		if result.Params.LastFlapTime == nil || flapTime.After(result.Params.LastFlapTime.Time) {
+			result.Params.LastFlapTime = jsonTime(flapTime)
+		}
+
+		// The coverage of the window is that of the rows the review kept
+		rowTime := portRow.Time.UTC()
+		if coverageStart == nil || rowTime.Before(*coverageStart) {
+			coverageStart = &rowTime
+		}
+		if coverageEnd == nil || rowTime.After(*coverageEnd) {
+			coverageEnd = &rowTime
+		}
+
+		if host.Ipaddress == "" {
+			host.FromDB(portRow)
+
+		} else if host.Ipaddress == portRow.Ipaddress {
+			host.UpdateFromDB(portRow)
+
+		} else {
+			result.Hosts = append(result.Hosts, *host)
+			host = &Host{}
+			host.FromDB(portRow)
+
+		}
+
+	}
+	if host.Ipaddress != "" {
+		result.Hosts = append(result.Hosts, *host)
+	}
+
+	minTransitions := q.MinTransitions
+	if minTransitions == 0 {
+		minTransitions = f.minTransitions
+	}
+	if minTransitions > 1 {
+		result.Hosts = dropSteadyPorts(result.Hosts, minTransitions)
+	}
+	if q.Status != "" {
+		result.Hosts = keepPortsInStatus(result.Hosts, q.Status)
+	}
+
+	if q.GroupBy == groupByAlias {
+		for i := range result.Hosts {
+			result.Hosts[i].GroupByAlias()
+		}
+	}
+
+	if windowMinutes := q.End.Sub(q.Start).Minutes(); windowMinutes > 0 {
+		for i := range result.Hosts {
+			for j := range result.Hosts[i].Ports {
+				port := &result.Hosts[i].Ports[j]
+				port.FlapRate = float64(port.FlapCount) / windowMinutes
+			}
+		}
+	}
+
+	for i := range result.Hosts {
+		for j := range result.Hosts[i].Ports {
+			port := &result.Hosts[i].Ports[j]
+			port.Status = f.portStatus(*port)
+			port.RecentlyActive = port.LastFlapTime != nil && q.End.Sub(port.LastFlapTime.Time) <= f.recentlyActive
+		}
+	}
+
+	if f.coverageScope == coverageScopeTable {
+		coverageStart, coverageEnd, err = f.Coverage(ctx)
+		if err != nil {
+			return result, err
+		}
+	}
+	if coverageStart != nil && coverageEnd != nil {
+		result.Params.CoverageStart = jsonTime(*coverageStart)
+		result.Params.CoverageEnd = jsonTime(*coverageEnd)
+	}
+
+	result.countTotals()
+	result.limitHosts(q.MaxHosts)
+	return result, nil
+
+}
+
+// sqlTime scans a time some drivers return as text, e.g. of an aggregate
+type sqlTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+func (t *sqlTime) Scan(value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		t.Valid = false
+		return nil
+	case time.Time:
+		t.Time = v
+	case string:
+		t.Time, err = time.Parse(timeFormat, v)
+	case []byte:
+		t.Time, err = time.Parse(timeFormat, string(v))
+	default:
+		return fmt.Errorf("unable to scan %T into a time", value)
+	}
+	t.Valid = err == nil
+	return err
+}
+
+// Coverage returns the time of the oldest and the newest row of the table,
+// nil if there are none
+func (f *Flapper) Coverage(ctx context.Context) (*time.Time, *time.Time, error) {
+	utcTime := f.dialect.UTC(f.columns.Time)
+	SQLQuery := fmt.Sprintf(`SELECT MIN(%[1]s), MAX(%[1]s)
+		FROM %[2]s;`,
+		utcTime,
+		f.table,
+	)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, SQLQuery)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var start, end sqlTime
+	if rows.Next() {
+		if err := rows.Scan(&start, &end); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if !start.Valid || !end.Valid {
+		return nil, nil, nil
+	}
+	startTime, endTime := start.Time.UTC(), end.Time.UTC()
+	return &startTime, &endTime, nil
+}
+
+// flapInterval is the time between two flaps of a port. The device uptime in
+// hundredths of a second is more precise than the time, it's used unless the device rebooted.
+func flapInterval(from, to PortRow) time.Duration {
+	if to.TimeTicks > from.TimeTicks && from.TimeTicks > 0 {
+		return time.Duration(to.TimeTicks-from.TimeTicks) * 10 * time.Millisecond
+	}
+	return to.Time.Sub(from.Time)
+}
+
+// debounce drops a down followed by an up of the same port within threshold.
+// Rows must be ordered by port and then by time.
+func debounce(rows []PortRow, threshold time.Duration) []PortRow {
+	kept := make([]PortRow, 0, len(rows))
+	for i := 0; i < len(rows); i++ {
+		if i+1 < len(rows) {
+			down, up := rows[i], rows[i+1]
+			if down.Ipaddress == up.Ipaddress && down.IfIndex == up.IfIndex &&
+				down.IfOperStatus == ifStatusDownCaption && up.IfOperStatus == ifStatusUpCaption &&
+				flapInterval(down, up) < threshold {
+				i++
+				continue
+			}
+		}
+		kept = append(kept, rows[i])
+	}
+	return kept
+}
+
+// dropSteadyPorts leaves out ports that changed their status fewer than min times,
+// e.g. went down once and stayed down, and the hosts left without ports
+func dropSteadyPorts(hosts []Host, min int) []Host {
+	kept := hosts[:0]
+	for _, host := range hosts {
+		ports := host.Ports[:0]
+		for _, port := range host.Ports {
+			if port.Transitions >= min {
+				ports = append(ports, port)
+			}
+		}
+		if len(ports) > 0 {
+			host.Ports = ports
+			kept = append(kept, host)
+		}
+	}
+	return kept
+}
+
+// keepPortsInStatus leaves out ports last seen in another ifOperStatus and hosts left without ports
+func keepPortsInStatus(hosts []Host, status string) []Host {
+	kept := hosts[:0]
+	for _, host := range hosts {
+		ports := host.Ports[:0]
+		for _, port := range host.Ports {
+			if port.IfOperStatus == status {
+				ports = append(ports, port)
+			}
+		}
+		if len(ports) > 0 {
+			host.Ports = ports
+			kept = append(kept, host)
+		}
+	}
+	return kept
+}
+
+// portStatus classifies a port: down if it is down now, otherwise unstable
+// if it flapped at least FlapThreshold times in the window
+func (f *Flapper) portStatus(port PortView) string {
+	switch {
+	case port.IfOperStatus == ifStatusDownCaption:
+		return portStatusDown
+	case port.FlapCount >= f.flapThreshold:
+		return portStatusUnstable
+	default:
+		return portStatusStable
+	}
+}
+
+// windowCondition selects rows between two UTC time arguments
+func (f *Flapper) windowCondition() string {
+	utcTime := f.dialect.UTC(f.columns.Time)
+	return fmt.Sprintf("%[1]s >= ? AND %[1]s <= ?", utcTime)
+}
+
+// portColumns is the SELECT list FetchFromDB scans into PortRow
+func (f *Flapper) portColumns() string {
+	c := f.columns
+	extended := "NULL, NULL"
+	if f.extendedColumns {
+		extended = c.IfSpeed + ", " + c.IfAdminStatus
+	}
+
+	return strings.Join([]string{
+		c.Id,
+		c.Sid,
+		f.dialect.UTC(c.Time),
+		c.TimeTicks,
+		c.Ipaddress,
+		c.Hostname,
+		c.IfIndex,
+		c.IfName,
+		c.IfAlias,
+		c.IfOperStatus,
+		extended,
+	}, ",\n\t\t")
+}
+
+// portOrder sorts rows by port, then chronologically.
+// Local times repeat when DST ends, so the order is taken in UTC.
+func (f *Flapper) portOrder() string {
+	c := f.columns
+	return fmt.Sprintf("%s, %s, %s ASC, %s ASC", c.Ipaddress, c.IfIndex, f.dialect.UTC(c.Time), c.TimeTicks)
+}
+
+// isStaleConnError tells errors of dead pooled connections from query errors
+func isStaleConnError(err error) bool {
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn)
+}
+
+// errDBUnavailable wraps errors of a database that can't be reached,
+// as opposed to a query it rejected, e.g. for a missing table
+var errDBUnavailable = errors.New("database unavailable")
+
+func isConnError(err error) bool {
+	var netErr net.Error
+	return isStaleConnError(err) || errors.As(err, &netErr)
+}
+
+// queryContext bounds a query by QueryTimeoutSec on top of the caller's context
+func (f *Flapper) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, f.queryTimeout)
+}
+
+// query runs a query, retrying it once if the pooled connection was dead
+func (f *Flapper) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := f.db.QueryContext(ctx, f.dialect.Rebind(query), args...)
+	if isStaleConnError(err) && ctx.Err() == nil {
+		// The server or a firewall dropped a pooled connection, a retry dials a fresh one
+		logContextf(ctx, levelWarn, "Lost DB connection, reconnecting: %s", err)
+		rows, err = f.db.QueryContext(ctx, f.dialect.Rebind(query), args...)
+	}
+	return rows, err
+}
+
+func (f *Flapper) FetchFromDB(ctx context.Context, query string, args ...interface{}) ([]PortRow, error) {
+	var portRows []PortRow
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, query, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if isConnError(err) {
+			logContextf(ctx, levelWarn, "Unable to connect DB: %s", err)
+			return nil, fmt.Errorf("%w: %s", errDBUnavailable, err)
+		}
+		logContextf(ctx, levelError, "Query failed: %s", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		portRow := PortRow{}
+		var ifOperStatus sql.NullString
+		err := rows.Scan(
+			&portRow.Id,
+			&portRow.Sid,
+			&portRow.Time,
+			&portRow.TimeTicks,
+			&portRow.Ipaddress,
+			&portRow.Hostname,
+			&portRow.IfIndex,
+			&portRow.IfName,
+			&portRow.IfAlias,
+			&ifOperStatus,
+			&portRow.IfSpeed,
+			&portRow.IfAdminStatus,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		portRow.Ipaddress = normalizeIP(portRow.Ipaddress)
+
+		// The collector leaves the status empty when the poll didn't capture it
+		portRow.IfOperStatus = ifStatusUnknownCaption
+		if ifOperStatus.Valid {
+			portRow.IfOperStatus = ifOperStatus.String
+		}
+		portRows = append(portRows, portRow)
+
+	}
+
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return portRows, nil
+}
+
+// PortFlaps returns up to limit flaps of a port newer than afterID.
+// The ifIndex names the port, so ExcludeIfNames doesn't hide it.
+func (f *Flapper) PortFlaps(ctx context.Context, q QueryParams, afterID int, limit int) ([]Flap, error) {
+
+	hostCondition, err := f.hostCondition(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	SQLQuery := fmt.Sprintf(`SELECT %s
+		FROM %s 
+		WHERE %s
+		AND %s AND %s = ? AND %s > ?
+		ORDER BY %s LIMIT %d;`,
+		f.portColumns(),
+		f.table,
+		f.windowCondition(),
+		hostCondition.SQL,
+		f.columns.IfIndex,
+		f.columns.Id,
+		f.portOrder(),
+		limit,
+	)
+
+	args := []interface{}{q.Start.Format(timeFormat), q.End.Format(timeFormat)}
+	args = append(args, hostCondition.Args...)
+	args = append(args, q.IfIndex, afterID)
+
+	portRows, err := f.fetchRows(ctx, SQLQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var flaps []Flap
+	for _, entry := range portRows {
+		if !q.IncludeSid {
+			entry.Sid = ""
+		}
+		flaps = append(flaps, entry.CreateFlap())
+	}
+	setDurations(flaps)
+
+	return flaps, nil
+}
+
+// setDurations pairs each flap with the next one of the opposite status.
+// The last flaps of a port have none and keep a nil duration.
+func setDurations(flaps []Flap) {
+	for i := range flaps {
+		if !flaps[i].IsUp() && !flaps[i].IsDown() {
+			continue
+		}
+		for j := i + 1; j < len(flaps); j++ {
+			// Unknown statuses and repeated traps of the same status don't end the state
+			if flaps[j].IsUp() == flaps[i].IsUp() || !flaps[j].IsUp() && !flaps[j].IsDown() {
+				continue
+			}
+			duration := int64(flaps[j].Time.Sub(flaps[i].Time.Time).Seconds())
+			flaps[i].DurationSec = &duration
+			break
+		}
+	}
+}
+
+// PriorFlap returns the last flap of a port before the window of q, nil if there is none
+func (f *Flapper) PriorFlap(ctx context.Context, q QueryParams) (*Flap, error) {
+	return f.LatestFlap(ctx, q, q.Start)
+}
+
+// LatestFlap returns the newest flap of a port before a time, or of all time if it's zero.
+// nil if there is none.
+func (f *Flapper) LatestFlap(ctx context.Context, q QueryParams, before time.Time) (*Flap, error) {
+
+	hostCondition, err := f.hostCondition(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	timeCondition := SQLCondition{SQL: "1 = 1"}
+	if !before.IsZero() {
+		timeCondition = SQLCondition{
+			SQL:  f.dialect.UTC(f.columns.Time) + " < ?",
+			Args: []interface{}{before.Format(timeFormat)},
+		}
+	}
+
+	SQLQuery := fmt.Sprintf(`SELECT %s
+		FROM %s
+		WHERE %s
+		AND %s AND %s = ?
+		ORDER BY %s DESC, %s DESC LIMIT 1;`,
+		f.portColumns(),
+		f.table,
+		timeCondition.SQL,
+		hostCondition.SQL,
+		f.columns.IfIndex,
+		f.dialect.UTC(f.columns.Time),
+		f.columns.TimeTicks,
+	)
+
+	args := timeCondition.Args
+	args = append(args, hostCondition.Args...)
+	args = append(args, q.IfIndex)
+
+	portRows, err := f.fetchRows(ctx, SQLQuery, args...)
+	if err != nil || len(portRows) == 0 {
+		return nil, err
+	}
+
+	flap := portRows[0].CreateFlap()
+	return &flap, nil
+}
+
+// FlapHistory is a page of flaps of a port
+type FlapHistory struct {
+	Flaps []Flap `json:"flaps"`
+	// More flaps follow, pass LastID as afterId to get them
+	HasMore bool `json:"hasMore"`
+	LastID  int  `json:"lastId"`
+}
+
+func (f *Flapper) FlapHistory(ctx context.Context, q QueryParams) (FlapHistory, error) {
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultFlapHistoryLimit
+	}
+
+	// One extra flap tells whether there is another page
+	flaps, err := f.store.PortFlaps(ctx, q, q.AfterID, limit+1)
+	if err != nil {
+		return FlapHistory{}, err
+	}
+
+	history := FlapHistory{Flaps: []Flap{}}
+	if len(flaps) > limit {
+		flaps = flaps[:limit]
+		history.HasMore = true
+	}
+	if len(flaps) > 0 {
+		history.Flaps = flaps
+		history.LastID = flaps[len(flaps)-1].Id
+	}
+	return history, nil
+}
+
+// Event is a flap flattened together with its port, a row of ?events
+type Event struct {
+	Id      int      `json:"id"`
+	Time    JSONTime `json:"time"`
+	Host    string   `json:"host"`
+	IP      string   `json:"ip"`
+	IfIndex int      `json:"ifIndex"`
+	IfName  string   `json:"ifName"`
+	IfAlias string   `json:"ifAlias"`
+	Status  string   `json:"status"`
+}
+
+// EventsResult is a page of flaps in the window, newest first
+type EventsResult struct {
+	Events []Event `json:"events"`
+	// Older flaps follow, pass LastID as afterId to get them
+	HasMore bool `json:"hasMore"`
+	LastID  int  `json:"lastId"`
+}
+
+// Events returns a page of the flaps in the window of q without aggregating them,
+// newest first. A page continues after the flap q.AfterID, older flaps come next.
+// Rows failing the keywords SQL can't evaluate are dropped from the page,
+// so it may hold fewer than limit events.
+func (f *Flapper) Events(ctx context.Context, q QueryParams) (EventsResult, error) {
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultFlapHistoryLimit
+	}
+	afterID := q.AfterID
+
+	// afterId of a review means newer flaps, here it is the cursor below
+	q.AfterID = 0
+	condition := f.reviewCondition(q)
+
+	if err := f.narrowToPort(ctx, q, &condition); err != nil {
+		return EventsResult{}, err
+	}
+
+	c := f.columns
+	utcTime := f.dialect.UTC(c.Time)
+	if afterID > 0 {
+		cursorTime := fmt.Sprintf("(SELECT %s FROM %s WHERE %s = ?)", utcTime, f.table, c.Id)
+		condition.SQL += fmt.Sprintf(" AND (%[1]s < %[2]s OR %[1]s = %[2]s AND %[3]s < ?)", utcTime, cursorTime, c.Id)
+		condition.Args = append(condition.Args, afterID, afterID, afterID)
+	}
+
+	// One extra flap tells whether there is another page
+	SQLQuery := fmt.Sprintf(`SELECT %s
+		FROM %s
+		WHERE %s
+		ORDER BY %s DESC, %s DESC LIMIT %d;`,
+		f.portColumns(),
+		f.table,
+		condition.SQL,
+		utcTime,
+		c.Id,
+		limit+1,
+	)
+
+	portRows, err := f.fetchRows(ctx, SQLQuery, condition.Args...)
+	if err != nil {
+		return EventsResult{}, err
+	}
+
+	result := EventsResult{Events: []Event{}}
+	if len(portRows) > limit {
+		portRows = portRows[:limit]
+		result.HasMore = true
+	}
+	for _, portRow := range portRows {
+		result.LastID = portRow.Id
+		if q.Filter.Match(portRow) {
+			result.Events = append(result.Events, eventFromRow(portRow))
+		}
+	}
+	return result, nil
+}
+
+// EventsSince returns up to limit flaps newer than the flap afterID, oldest first,
+// regardless of any window, and the id to continue after next time. Rows failing
+// the keywords SQL can't evaluate are skipped. ?stream polls it for new flaps.
+func (f *Flapper) EventsSince(ctx context.Context, q QueryParams, afterID int, limit int) ([]Event, int, error) {
+	exclusion := f.ifNameExclusionFor(q)
+
+	c := f.columns
+	condition := SQLCondition{
+		SQL:  c.Id + " > ? " + exclusion.SQL + " " + strings.Join(q.Filter.Conditions, " "),
+		Args: []interface{}{afterID},
+	}
+	condition.Args = append(condition.Args, exclusion.Args...)
+	condition.Args = append(condition.Args, q.Filter.Args...)
+	if err := f.narrowToPort(ctx, q, &condition); err != nil {
+		return nil, afterID, err
+	}
+
+	SQLQuery := fmt.Sprintf(`SELECT %s
+		FROM %s
+		WHERE %s
+		ORDER BY %s LIMIT %d;`,
+		f.portColumns(),
+		f.table,
+		condition.SQL,
+		c.Id,
+		limit,
+	)
+
+	portRows, err := f.fetchRows(ctx, SQLQuery, condition.Args...)
+	if err != nil {
+		return nil, afterID, err
+	}
+
+	events := []Event{}
+	for _, portRow := range portRows {
+		afterID = portRow.Id
+		if q.Filter.Match(portRow) {
+			events = append(events, eventFromRow(portRow))
+		}
+	}
+	return events, afterID, nil
+}
+
+// NewestID returns the id of the newest flap in the table, 0 if there are none
+func (f *Flapper) NewestID(ctx context.Context) (int, error) {
+	SQLQuery := fmt.Sprintf(`SELECT COALESCE(MAX(%s), 0) FROM %s;`, f.columns.Id, f.table)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	var id int
+	err := f.db.QueryRowContext(ctx, SQLQuery).Scan(&id)
+	if err != nil && ctx.Err() != nil {
+		return id, ctx.Err()
+	}
+	return id, err
+}
+
+// narrowToPort adds the host and ifindex of q, when given, to condition
+func (f *Flapper) narrowToPort(ctx context.Context, q QueryParams, condition *SQLCondition) error {
+	if q.Host != "" {
+		hostCondition, err := f.hostCondition(ctx, q)
+		if err != nil {
+			return err
+		}
+		condition.SQL += " AND " + hostCondition.SQL
+		condition.Args = append(condition.Args, hostCondition.Args...)
+	}
+	if q.IfIndex != 0 {
+		condition.SQL += " AND " + f.columns.IfIndex + " = ?"
+		condition.Args = append(condition.Args, q.IfIndex)
+	}
+	return nil
+}
+
+func eventFromRow(portRow PortRow) Event {
+	port := PortView{}
+	port.FromDB(portRow)
+	flap := portRow.CreateFlap()
+
+	event := Event{
+		Id:      flap.Id,
+		Time:    flap.Time,
+		IP:      portRow.Ipaddress,
+		IfIndex: port.IfIndex,
+		IfName:  port.IfName,
+		IfAlias: port.IfAlias,
+		Status:  flap.IfOperStatus,
+	}
+	if portRow.Hostname != nil {
+		event.Host = *portRow.Hostname
+	}
+	return event
+}
+
+// errEmptyWindow is returned for a chart whose end isn't after its start
+var errEmptyWindow = errors.New("end must be after start")
+
+// FlapTimeline is a flap chart before rendering: one state per column
+type FlapTimeline struct {
+	IfIndex       int            `json:"ifIndex"`
+	Start         JSONTime       `json:"start"`
+	End           JSONTime       `json:"end"`
+	BucketSeconds float64        `json:"bucketSeconds"`
+	States        []int          `json:"states"`
+	Legend        map[int]string `json:"legend"`
+	// Meaning of each caption of Legend
+	Descriptions map[string]string `json:"descriptions"`
+}
+
+func (f *Flapper) Timeline(ctx context.Context, q QueryParams) (FlapTimeline, error) {
+	if q.End.Unix()-q.Start.Unix() <= 0 {
+		return FlapTimeline{}, errEmptyWindow
+	}
+
+	flaps, err := f.store.PortFlaps(ctx, q, 0, defaultFlapHistoryLimit)
+	if err != nil {
+		return FlapTimeline{}, err
+	}
+
+	// The last flap before the window tells the state the chart starts in
+	prior, err := f.PriorFlap(ctx, q)
+	if err != nil {
+		return FlapTimeline{}, err
+	}
+
+	// Without it, the oldest row of the table tells since when the port
+	// was monitored and would have flapped
+	var monitoredFrom *time.Time
+	if prior == nil && len(flaps) > 0 {
+		monitoredFrom, _, err = f.Coverage(ctx)
+		if err != nil {
+			return FlapTimeline{}, err
+		}
+	}
+
+	timeLine, cent := f.timelineStates(q, flaps, prior, monitoredFrom)
+
+	return FlapTimeline{
+		IfIndex:       q.IfIndex,
+		Start:         JSONTime{q.Start},
+		End:           JSONTime{q.End},
+		BucketSeconds: cent,
+		States:        timeLine,
+		Legend:        chartStateCaptions,
+		Descriptions:  chartStateDescriptions,
+	}, nil
+}
+
+// timelineStates returns the chart state of every column of the window q and
+// the seconds a column spans
+func (f *Flapper) timelineStates(q QueryParams, flaps []Flap, prior *Flap, monitoredFrom *time.Time) ([]int, float64) {
+
+	/*
+		12:00			 13:00
+		3600         1800          0 3600/333=10.81  1800/10.81 = 166
+		 40          20/           0. 40/333=0.12012 20/0.1201 = 166
+		 500	     250          0
+		 [0 0 0 0 1 1 1 0 0 0 1 1 1]
+		333          160          0.  500/333 = 1.5 250 / 1.5 = 166
+
+		Cent := intervalSeconds / 333
+		y := flapSecond / Cent
+
+	*/
+
+	intervalSeconds := q.End.Unix() - q.Start.Unix()
+	width, _ := q.chartSize()
+	cent := float64(intervalSeconds) / float64(width-1)
+
+	timeLine := make([]int, width)
+	// The last down flap of a column was a shutdown
+	adminDown := make([]bool, width)
+	// Flaps of each direction in a column, a brief up within a long down
+	// period must not repaint the columns after it with f.dominantColumns
+	ups := make([]int, width)
+	downs := make([]int, width)
+
+	// The last flap of a column sets its direction, flaps of the same second
+	// must not depend on the order the database returned them in
+	sort.SliceStable(flaps, func(i, j int) bool {
+		return flaps[i].Before(flaps[j])
+	})
+
+	for _, flap := range flaps {
+
+		// A row without a known status is not a transition
+		if !flap.IsUp() && !flap.IsDown() {
+			continue
+		}
+
+		secondsFromStart := flap.Time.Unix() - q.Start.Unix()
+		floatX := float64(secondsFromStart) / cent
+		x := int(floatX)
+
+		// The query is bounded by the window, but a skewed or broken time must not crash the chart
+		if floatX < 0 || x >= width {
+			logf(levelDebug, "flap %d at %s is out of the chart window, skipped", flap.Id, flap.Time)
+			continue
+		}
+
+		if flap.IsUp() {
+			ups[x]++
+		} else {
+			downs[x]++
+			adminDown[x] = flap.AdminInduced
+		}
+
+		val := timeLine[x]
+		if val == chartStateUnknown {
+			if flap.IsUp() {
+				timeLine[x] = chartStateUp
+			} else if adminDown[x] {
+				timeLine[x] = chartStateAdminDown
+			} else {
+				timeLine[x] = chartStateDown
+			}
+		} else {
+			up := flap.IsUp()
+			if f.dominantColumns && ups[x] != downs[x] {
+				up = ups[x] > downs[x]
+			}
+			if up {
+				timeLine[x] = chartStateFlappingUp
+			} else {
+				timeLine[x] = chartStateFlappingDown
+			}
+
+		}
+	}
+
+	// Resolve columns without flaps to the state the port stayed in.
+	// A shut down port stays in the admin down color.
+	status := chartStateUnknown
+	if prior != nil && prior.IsUp() {
+		status = chartStateUp
+	} else if prior != nil && prior.IsDown() && prior.AdminInduced {
+		status = chartStateAdminDown
+	} else if prior != nil && prior.IsDown() {
+		status = chartStateDown
+	}
+
+	// Without a flap before the window the port was in the state opposite
+	// to its first flap, but only since it was monitored. The columns
+	// before that stay unknown, nothing is known about the port then.
+	fallback, fallbackFrom := chartStateUnknown, width
+	if prior == nil && monitoredFrom != nil {
+		for _, flap := range flaps {
+			if flap.IsUp() {
+				fallback = chartStateDown
+			} else if flap.IsDown() {
+				fallback = chartStateUp
+			} else {
+				continue
+			}
+			break
+		}
+		fallbackFrom = 0
+		if monitoredFrom.After(q.Start) {
+			fallbackFrom = int(float64(monitoredFrom.Unix()-q.Start.Unix()) / cent)
+		}
+	}
+
+	for i, state := range timeLine {
+		if status == chartStateUnknown && i >= fallbackFrom {
+			status = fallback
+		}
+		switch state {
+		case chartStateUnknown:
+			if status == chartStateUp {
+				timeLine[i] = chartStateSteadyUp
+			} else if status == chartStateDown {
+				timeLine[i] = chartStateSteadyDown
+			} else if status == chartStateAdminDown {
+				timeLine[i] = chartStateAdminDown
+			}
+
+		case chartStateUp, chartStateFlappingUp:
+			status = chartStateUp
+
+		case chartStateDown, chartStateFlappingDown, chartStateAdminDown:
+			status = chartStateDown
+			if adminDown[i] {
+				status = chartStateAdminDown
+			}
+
+		}
+	}
+
+	return timeLine, cent
+}
+
+// AmbiguousHostError is returned for a hostname used by several addresses
+type AmbiguousHostError struct {
+	Hostname  string
+	Addresses []string
+}
+
+func (e AmbiguousHostError) Error() string {
+	return fmt.Sprintf("%s has several addresses, use one of %s", e.Hostname, strings.Join(e.Addresses, ", "))
+}
+
+// ResolveHost returns the address of a host given by its hostname.
+// An address is returned as is, so is a hostname the table doesn't know.
+func (f *Flapper) ResolveHost(ctx context.Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	SQLQuery := fmt.Sprintf(`SELECT DISTINCT %s FROM %s WHERE %s = ?;`,
+		f.columns.Ipaddress,
+		f.table,
+		f.columns.Hostname,
+	)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	rows, err := f.query(ctx, SQLQuery, host)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
+	}
+	defer rows.Close()
+
+	var addresses []string
+	seen := map[string]bool{}
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			return "", err
+		}
+		address = normalizeIP(address)
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	switch len(addresses) {
+	case 0:
+		return host, nil
+	case 1:
+		return addresses[0], nil
+	default:
+		sort.Strings(addresses)
+		return "", AmbiguousHostError{Hostname: host, Addresses: addresses}
+	}
+}
+
+// hostCondition selects the rows of q.Host.
+// An IPv6 address is matched in any spelling the collector stored it in.
+func (f *Flapper) hostCondition(ctx context.Context, q QueryParams) (SQLCondition, error) {
+	if !isIPv6(q.Host) {
+		return SQLCondition{SQL: f.columns.Ipaddress + " = ?", Args: []interface{}{q.Host}}, nil
+	}
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	query := fmt.Sprintf(`SELECT DISTINCT %[1]s FROM %[2]s WHERE %[3]s AND %[1]s LIKE ?;`,
+		f.columns.Ipaddress,
+		f.table,
+		f.windowCondition(),
+	)
+	rows, err := f.db.QueryContext(ctx, f.dialect.Rebind(query), q.Start.Format(timeFormat), q.End.Format(timeFormat), "%:%")
+	if err != nil {
+		if ctx.Err() != nil {
+			return SQLCondition{}, ctx.Err()
+		}
+		return SQLCondition{}, err
+	}
+	defer rows.Close()
+
+	canonical := normalizeIP(q.Host)
+	condition := SQLCondition{Args: []interface{}{q.Host}}
+	for rows.Next() {
+		var stored string
+		if err := rows.Scan(&stored); err != nil {
+			return SQLCondition{}, err
+		}
+		if stored != q.Host && normalizeIP(stored) == canonical {
+			condition.Args = append(condition.Args, stored)
+		}
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(condition.Args)), ", ")
+	condition.SQL = fmt.Sprintf("%s IN (%s)", f.columns.Ipaddress, placeholders)
+	return condition, rows.Err()
+}
+
+// hostsCondition selects the rows of q.Hosts, each address in its stored spellings
+func (f *Flapper) hostsCondition(ctx context.Context, q QueryParams) (SQLCondition, error) {
+	var args []interface{}
+	seen := map[interface{}]bool{}
+	for _, host := range q.Hosts {
+		q.Host = host
+		hostCondition, err := f.hostCondition(ctx, q)
+		if err != nil {
+			return SQLCondition{}, err
+		}
+		for _, arg := range hostCondition.Args {
+			if !seen[arg] {
+				seen[arg] = true
+				args = append(args, arg)
+			}
+		}
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	return SQLCondition{SQL: fmt.Sprintf("%s IN (%s)", f.columns.Ipaddress, placeholders), Args: args}, nil
+}
+
+// LatestFlapID returns the newest flap id of a port within a window, 0 if none
+func (f *Flapper) LatestFlapID(ctx context.Context, q QueryParams) (int, error) {
+
+	hostCondition, err := f.hostCondition(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	// Without an ifindex any port of the host counts, as for a host overview chart
+	ifIndexCondition := SQLCondition{SQL: "1 = 1"}
+	if q.IfIndex != 0 {
+		ifIndexCondition = SQLCondition{SQL: f.columns.IfIndex + " = ?", Args: []interface{}{q.IfIndex}}
+	}
+	if len(q.IfIndexes) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(q.IfIndexes)), ", ")
+		ifIndexCondition = SQLCondition{SQL: fmt.Sprintf("%s IN (%s)", f.columns.IfIndex, placeholders)}
+		for _, ifIndex := range q.IfIndexes {
+			ifIndexCondition.Args = append(ifIndexCondition.Args, ifIndex)
+		}
+	}
+
+	SQLQuery := fmt.Sprintf(`SELECT COALESCE(MAX(%s), 0)
+		FROM %s 
+		WHERE %s
+		AND %s AND %s;`,
+		f.columns.Id,
+		f.table,
+		f.windowCondition(),
+		hostCondition.SQL,
+		ifIndexCondition.SQL,
+	)
+
+	args := []interface{}{q.Start.Format(timeFormat), q.End.Format(timeFormat)}
+	args = append(args, hostCondition.Args...)
+	args = append(args, ifIndexCondition.Args...)
+
+	ctx, cancel := f.queryContext(ctx)
+	defer cancel()
+
+	var id int
+	err = f.db.QueryRowContext(ctx, f.dialect.Rebind(SQLQuery), args...).Scan(&id)
+	if err != nil && ctx.Err() != nil {
+		return id, ctx.Err()
+	}
+
+	return id, err
+}
+
+func (f *Flapper) FlapChart(ctx context.Context, q QueryParams) (*FlapsDiagram, error) {
+
+	timeline, err := f.Timeline(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	flapsDiagram := CreateFlapsDiagram(q.chartSize())
+	flapsDiagram.drawStrip(0, f.colorLine(timeline))
+	return flapsDiagram, nil
+}
+
+// PortTimelines computes the timelines of q.IfIndexes in order
+func (f *Flapper) PortTimelines(ctx context.Context, q QueryParams) ([]FlapTimeline, error) {
+	timelines := make([]FlapTimeline, 0, len(q.IfIndexes))
+	for _, ifIndex := range q.IfIndexes {
+		portQuery := q
+		portQuery.IfIndex = ifIndex
+		timeline, err := f.Timeline(ctx, portQuery)
+		if err != nil {
+			return nil, err
+		}
+		timelines = append(timelines, timeline)
+	}
+	return timelines, nil
+}
+
+// StackedFlapChart draws a strip per port of q.IfIndexes, labelled with q.labels if any.
+// A port without flaps in the window is drawn unknown.
+func (f *Flapper) StackedFlapChart(ctx context.Context, q QueryParams) (*FlapsDiagram, error) {
+
+	timelines, err := f.PortTimelines(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	labelHeight := 0
+	if len(q.labels) > 0 {
+		labelHeight = flapChartLabelHeight
+	}
+
+	width, height := q.chartSize()
+	flapsDiagram := createStackedDiagram(len(timelines), labelHeight, width, height)
+	for n, timeline := range timelines {
+		if n < len(q.labels) {
+			flapsDiagram.drawLabel(n, q.labels[n])
+		}
+		flapsDiagram.drawStrip(n, f.colorLine(timeline))
+	}
+	return flapsDiagram, nil
+}
+
+// HostPorts returns the ports of q.Host that flapped in the window, most flapping first.
+// Like the review it leaves out ports with fewer than q.MinTransitions, or MinTransitions, status changes.
+func (f *Flapper) HostPorts(ctx context.Context, q QueryParams) ([]PortView, error) {
+	hostQuery := q
+	hostQuery.AfterID = 0
+	hostQuery.GroupBy = ""
+	hostQuery.Filter = Filter{}
+	hostQuery.Filter.Require(filterToken{exact: true, columns: []string{"ipaddress"}, value: q.Host}, f.columns, f.dialect)
+
+	result, err := f.store.Review(ctx, hostQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var ports []PortView
+	for _, host := range result.Hosts {
+		ports = append(ports, host.Ports...)
+	}
+	// Ties are broken by ifIndex, so a chart keeps its strips in place between refreshes
+	sort.SliceStable(ports, func(i, j int) bool {
+		if ports[i].FlapCount != ports[j].FlapCount {
+			return ports[i].FlapCount > ports[j].FlapCount
+		}
+		return ports[i].IfIndex < ports[j].IfIndex
+	})
+	return ports, nil
+}
+
+// colorLine fills a timeline with colors
+func (f *Flapper) colorLine(timeline FlapTimeline) []color.RGBA {
+	colorLine := make([]color.RGBA, len(timeline.States))
+
+	for i, state := range timeline.States {
+		switch state {
+		case chartStateUnknown:
+			colorLine[i] = f.palette.Unknown
+
+		case chartStateSteadyUp:
+			colorLine[i] = f.palette.UpState
+
+		case chartStateSteadyDown:
+			colorLine[i] = f.palette.DownState
+
+		case chartStateUp:
+			colorLine[i] = f.palette.Up
+
+		case chartStateDown:
+			colorLine[i] = f.palette.Down
+
+		case chartStateFlappingUp, chartStateFlappingDown:
+			colorLine[i] = f.palette.Flapping
+
+		case chartStateAdminDown:
+			colorLine[i] = f.palette.AdminDown
+
+		}
+	}
+	return colorLine
+}
+
+// SERVER
+
+type Server struct {
+	flapper *Flapper
+	// Flappers of the named sources
+	flappers    map[string]*Flapper
+	chartCache  *ChartCache
+	reviewCache *ChartCache
+	limiter     *RateLimiter
+	streams     *StreamLimiter
+	queries     *QueryLimiter // nil without MaxConcurrentQueries
+	// Closed when the server shuts down, ending the open streams and keepalive pings
+	shutdown   chan struct{}
+	keepalives *sync.WaitGroup
+}
+
+// forSource returns a copy of the server querying the flapper of q.Source
+func (s *Server) forSource(q QueryParams) *Server {
+	if q.Source == "" {
+		return s
+	}
+	source := *s
+	source.flapper = s.flappers[q.Source]
+	return &source
+}
+
+// IndexResult is the index page for clients accepting JSON
+type IndexResult struct {
+	Service string `json:"service"`
+	Env     string `json:"env"`
+	Version string `json:"version"`
+	Banner  string `json:"banner"`
+}
+
+func (s Server) Index(response http.ResponseWriter, request *http.Request) {
+	if !acceptsJSON(request) {
+		response.Write([]byte(config.BannerText))
+		return
+	}
+
+	jsonResult, err := json.Marshal(IndexResult{
+		Service: "flapmyport",
+		Env:     config.InstanceEnv,
+		Version: version,
+		Banner:  config.BannerText,
+	})
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResult)
+}
+
+// acceptsJSON tells whether Accept asks for JSON, plain or of an API version
+func acceptsJSON(request *http.Request) bool {
+	for _, accept := range request.Header.Values("Accept") {
+		for _, item := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(item))
+			if err == nil && (mediaType == "application/json" || apiVersionRe.MatchString(mediaType)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func (s Server) httpError(response http.ResponseWriter, status int, code, message string) {
+	body, _ := json.Marshal(ErrorResponse{Error: message, Code: code})
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	response.Write(body)
+}
+
+func (s Server) http400(response http.ResponseWriter, message string) {
+
+	if message == "" {
+		message = "Bad request"
+	}
+	s.httpError(response, http.StatusBadRequest, "bad_request", message)
+}
+
+func (s Server) http500(response http.ResponseWriter) {
+	s.httpError(response, http.StatusInternalServerError, "internal_error", "Internal server error")
+}
+
+func (s Server) http429(response http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	response.Header().Set("Retry-After", strconv.Itoa(seconds))
+	s.httpError(response, http.StatusTooManyRequests, "too_many_requests", "Too many requests")
+}
+
+// trustedProxies are the parsed Config.TrustedProxies
+var trustedProxies []*net.IPNet
+
+// parseCIDRs reads a list of subnets, a bare address stands for itself
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q", item)
+		}
+		nets = append(nets, subnet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, subnet := range trustedProxies {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address requests are accounted to.
+// Behind trusted proxies it is the rightmost X-Forwarded-For entry
+// not added by one of them, other peers can't set it.
+func clientIP(request *http.Request) string {
+	peer, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		peer = request.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
+	forwarded := request.Header.Values("X-Forwarded-For")
+	entries := strings.Split(strings.Join(forwarded, ","), ",")
+
+	// Each proxy appends the address it saw to the end of the list
+	client := peer
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			continue
+		}
+		client = entry
+		if config.TrustProxy || !isTrustedProxy(entry) {
+			break
+		}
+	}
+	return client
+}
+
+// httpQueryError answers a request whose DB query didn't complete
+func (s Server) httpQueryError(response http.ResponseWriter, request *http.Request, err error) {
+	logRequestf(request, levelWarn, "query error: %s", err)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// Nobody reads the answer, the status is only for the access log
+		s.httpError(response, statusClientClosedRequest, "client_closed_request", "Client closed request")
+
+	case errors.Is(err, context.DeadlineExceeded):
+		s.httpError(response, http.StatusServiceUnavailable, "timeout", "Database query timed out")
+
+	case errors.Is(err, errDBUnavailable):
+		s.httpError(response, http.StatusServiceUnavailable, "db_unavailable", "Database unavailable")
+
+	default:
+		s.http500(response)
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (s Server) http401(response http.ResponseWriter) {
+	if config.BasicAuthUser != "" {
+		response.Header().Set("WWW-Authenticate", `Basic realm="flapmyport_api", charset="UTF-8"`)
+	}
+	s.httpError(response, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+}
+
+// authorized reports whether a request carries one of the configured API keys
+// or the Basic Auth credentials. Any request is authorized when neither is configured.
+func (s *Server) authorized(request *http.Request) bool {
+	if len(config.APIKeys) == 0 && config.BasicAuthUser == "" {
+		return true
+	}
+
+	if config.BasicAuthUser != "" {
+		if user, password, ok := request.BasicAuth(); ok {
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(config.BasicAuthUser)) == 1
+			passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(config.BasicAuthPassword)) == 1
+			if userOK && passwordOK {
+				return true
+			}
+		}
+	}
+
+	key := request.Header.Get(headerAPIKey)
+	if key == "" {
+		key = request.URL.Query().Get(getParamKey)
+	}
+	if key == "" {
+		return false
+	}
+
+	for _, apiKey := range config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// windowAllowed guards the DB against accidental full table scans
+func (s *Server) windowAllowed(response http.ResponseWriter, request *http.Request, q QueryParams) bool {
+	maxWindow := time.Duration(config.MaxWindowHours) * time.Hour
+	if maxWindow > 0 && q.End.Sub(q.Start) > maxWindow {
+		msg := fmt.Sprintf("review window exceeds the limit of %d hours", config.MaxWindowHours)
+		logRequestf(request, levelInfo, "error: %s", msg)
+		s.http400(response, msg)
+		return false
+	}
+	return true
+}
+
+func (s *Server) HandleReview(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if !s.windowAllowed(response, request, q) {
+		return
+	}
+
+	if q.MaxHosts == 0 {
+		q.MaxHosts = config.MaxHosts
+	}
+	// A single host, already resolved from its name, is a list of one
+	if q.Host != "" && len(q.Hosts) == 0 {
+		q.Hosts = []string{q.Host}
+	}
+
+	// Dashboards polling the same review share one query per ReviewCacheTTLSec
+	ttl := time.Duration(config.ReviewCacheTTLSec) * time.Second
+	cacheKey := ""
+	if ttl > 0 {
+		cacheKey = reviewCacheKey(alignReviewWindow(q, ttl))
+		if cached, ok := s.reviewCache.Get(cacheKey); cacheKey != "" && ok {
+			response.Header().Add("Content-Type", cached.contentType)
+			response.Write(cached.body)
+			return
+		}
+	}
+
+	results, err := s.flapper.store.Review(request.Context(), q)
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	if q.Format == formatNDJSON {
+		writeNDJSON(response, request, results)
+		return
+	}
+
+	jsonResults, err := json.Marshal(results)
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	if cacheKey != "" {
+		s.reviewCache.Add(chartCacheEntry{
+			key:         cacheKey,
+			contentType: "application/json",
+			body:        jsonResults,
+			expires:     time.Now().Add(ttl),
+		})
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+
+}
+
+// writeNDJSON writes a review as a line with its params followed by a line per host,
+// flushing every line so consumers can process hosts as they arrive
+func writeNDJSON(response http.ResponseWriter, request *http.Request, results ReviewResult) {
+	response.Header().Add("Content-Type", "application/x-ndjson")
+	flusher, _ := response.(http.Flusher)
+
+	encoder := json.NewEncoder(response)
+	lines := []interface{}{struct {
+		Params Params `json:"params"`
+	}{results.Params}}
+	for _, host := range results.Hosts {
+		lines = append(lines, host)
+	}
+
+	for _, line := range lines {
+		// Encode ends every object with a newline
+		if err := encoder.Encode(line); err != nil {
+			logRequestf(request, levelWarn, "error: %s", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// alignReviewWindow rounds the window of q to the second. A window ending about now is moved
+// back to the last multiple of ttl, so rapid polls share a cache key.
+func alignReviewWindow(q QueryParams, ttl time.Duration) QueryParams {
+	q.Start, q.End = q.Start.Truncate(time.Second), q.End.Truncate(time.Second)
+	if time.Since(q.End) < ttl {
+		shift := q.End.Sub(q.End.Truncate(ttl))
+		q.Start, q.End = q.Start.Add(-shift), q.End.Add(-shift)
+	}
+	return q
+}
+
+// reviewCacheKey identifies a review by its normalized query and the
+// blacklist it was built with, empty if it can't be cached
+func reviewCacheKey(q QueryParams) string {
+	params, err := json.Marshal(q)
+	if err != nil {
+		return ""
+	}
+	key := fmt.Sprintf("%s|%v|%v|%d", params, q.Filter.rowKeywords, q.Filter.anyRowKeywords, blacklist.Generation())
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// HostsResult is the answer to ?hosts
+type HostsResult struct {
+	Hosts []HostEntry `json:"hosts"`
+	Total int         `json:"total"` // hosts on every page
+}
+
+// discoveryPage returns the bounds of the page of n entries q asks for,
+// DiscoveryLimit entries long unless it has a limit
+func discoveryPage(n int, q QueryParams) (int, int) {
+	limit := q.Limit
+	if limit == 0 {
+		limit = config.DiscoveryLimit
+	}
+
+	first, last := q.Offset, n
+	if first > n {
+		first = n
+	}
+	if limit > 0 && first+limit < n {
+		last = first + limit
+	}
+	return first, last
+}
+
+func (s *Server) HandleHosts(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if !s.windowAllowed(response, request, q) {
+		return
+	}
+
+	hosts, err := s.flapper.Hosts(request.Context(), q)
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	first, last := discoveryPage(len(hosts), q)
+	jsonResults, err := json.Marshal(HostsResult{Hosts: hosts[first:last], Total: len(hosts)})
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+}
+
+// RecentResult is the answer to ?recent
+type RecentResult struct {
+	Flaps []RecentFlap `json:"flaps"`
+}
+
+func (s *Server) HandleRecent(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	count := q.Count
+	if count == 0 {
+		count = defaultRecentCount
+	}
+	if count > config.MaxRecentFlaps {
+		count = config.MaxRecentFlaps
+	}
+
+	flaps, err := s.flapper.RecentFlaps(request.Context(), q, count)
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	jsonResults, err := json.Marshal(RecentResult{Flaps: flaps})
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+}
+
+// InterfacesResult is the answer to ?interfaces
+type InterfacesResult struct {
+	Interfaces []InterfaceEntry `json:"interfaces"`
+	Total      int              `json:"total"` // interfaces on every page
+}
+
+func (s *Server) HandleInterfaces(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if q.Host == "" {
+		msg := fmt.Sprintf("%s not given", getParamHost)
+		logRequestf(request, levelInfo, "error: %s", msg)
+		s.http400(response, msg)
+		return
+	}
+	if !s.windowAllowed(response, request, q) {
+		return
+	}
+
+	interfaces, err := s.flapper.Interfaces(request.Context(), q)
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	first, last := discoveryPage(len(interfaces), q)
+	jsonResults, err := json.Marshal(InterfacesResult{Interfaces: interfaces[first:last], Total: len(interfaces)})
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+}
+
+// StatsBucketsResult is the answer to ?stats
+type StatsBucketsResult struct {
+	Bucket  string        `json:"bucket"`
+	Buckets []StatsBucket `json:"buckets"`
+}
+
+// StatsTopResult is the answer to ?stats&topn
+type StatsTopResult struct {
+	Top []StatsTopEntry `json:"top"`
+}
+
+func (s *Server) HandleStats(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if !s.windowAllowed(response, request, q) {
+		return
+	}
+
+	var stats interface{}
+	var err error
+	if q.TopN > 0 {
+		var top []StatsTopEntry
+		top, err = s.flapper.TopFlapping(request.Context(), q)
+		stats = StatsTopResult{Top: top}
+	} else {
+		var buckets []StatsBucket
+		buckets, err = s.flapper.FlapBuckets(request.Context(), q)
+		stats = StatsBucketsResult{Bucket: q.Bucket, Buckets: buckets}
+	}
+	if err == errStatsRowKeywords {
+		logRequestf(request, levelInfo, "error: %s", err)
+		s.http400(response, err.Error())
+		return
+	}
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	jsonResults, err := json.Marshal(stats)
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+}
+
+// AliasStatsResult is the answer to ?aliasstats
+type AliasStatsResult struct {
+	Aliases []AliasStatsEntry `json:"aliases"`
+}
+
+func (s *Server) HandleAliasStats(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if !s.windowAllowed(response, request, q) {
+		return
+	}
+
+	aliases, err := s.flapper.AliasStats(request.Context(), q)
+	if err == errStatsRowKeywords {
+		logRequestf(request, levelInfo, "error: %s", err)
+		s.http400(response, err.Error())
+		return
+	}
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	jsonResults, err := json.Marshal(AliasStatsResult{Aliases: aliases})
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+}
+
+func (s *Server) HandleFlapHistory(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if q.Host == "" {
+		msg := fmt.Sprintf("%s not given", getParamHost)
+		logRequestf(request, levelInfo, "error: %s", msg)
+		s.http400(response, msg)
+		return
+	}
+	if q.IfIndex == 0 {
+		msg := fmt.Sprintf("%s not given", getParamIfIndex)
+		logRequestf(request, levelInfo, "error: %s", msg)
+		s.http400(response, msg)
+		return
+	}
+
+	history, err := s.flapper.FlapHistory(request.Context(), q)
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	jsonResults, err := json.Marshal(history)
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+}
+
+func (s *Server) HandleEvents(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if !s.windowAllowed(response, request, q) {
+		return
+	}
+
+	events, err := s.flapper.Events(request.Context(), q)
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+
+	jsonResults, err := json.Marshal(events)
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResults)
+}
+
+// HandleStream pushes flaps as Server-Sent Events as the collector writes them.
+// The stream starts after the newest flap, or after the one in Last-Event-ID
+// or afterId, so a reconnecting client gets the flaps it missed.
+func (s *Server) HandleStream(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		logRequestf(request, levelError, "error: streaming unsupported")
+		s.http500(response)
+		return
+	}
+
+	lastID := q.AfterID
+	if lastEventID := request.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, err := strconv.Atoi(lastEventID)
+		if err != nil || id < 0 {
+			logRequestf(request, levelInfo, "invalid Last-Event-ID: %s", lastEventID)
+			s.http400(response, "invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+
+	client := clientIP(request)
+	if !s.streams.Acquire(client) {
+		logRequestf(request, levelInfo, "error: %s has %d streams open", client, config.MaxStreams)
+		s.httpError(response, http.StatusTooManyRequests, "too_many_streams", "Too many streams")
+		return
+	}
+	defer s.streams.Release(client)
+
+	ctx := request.Context()
+	if lastID == 0 {
+		id, err := s.flapper.NewestID(ctx)
+		if err != nil {
+			s.httpQueryError(response, request, err)
+			return
+		}
+		lastID = id
+	}
+
+	// The server gives up writing after WriteTimeoutSec, the stream ends before
+	// and the client reconnects with Last-Event-ID
+	var end <-chan time.Time
+	if config.WriteTimeoutSec > 0 {
+		timer := time.NewTimer(time.Duration(config.WriteTimeoutSec) * time.Second * 9 / 10)
+		defer timer.Stop()
+		end = timer.C
+	}
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the events
+	response.Header().Set("X-Accel-Buffering", "no")
+
+	// An event without data only sets the id a client resumes from
+	fmt.Fprintf(response, "id: %d\n\n", lastID)
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Duration(config.StreamPollSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.shutdown:
+			return
+		case <-end:
+			return
+		case <-ticker.C:
+		}
+
+		events, nextID, err := s.flapper.EventsSince(ctx, q, lastID, streamBatchSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// The database may be back by the next poll
+			logRequestf(request, levelWarn, "stream: %s", err)
+			continue
+		}
+
+		// A comment keeps proxies from closing a quiet stream
+		if len(events) == 0 {
+			if _, err := fmt.Fprint(response, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				logRequestf(request, levelError, "error: %s", err)
+				return
+			}
+			if _, err := fmt.Fprintf(response, "id: %d\ndata: %s\n\n", event.Id, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		lastID = nextID
+	}
+}
+
+// PortStatusResult is the answer to ?portstatus
+type PortStatusResult struct {
+	IfOperStatus string   `json:"ifOperStatus"`
+	LastChange   JSONTime `json:"lastChange"`
+}
+
+func (s *Server) HandlePortStatus(response http.ResponseWriter, request *http.Request, q QueryParams) {
+
+	if q.Host == "" || q.IfIndex == 0 {
+		msg := fmt.Sprintf("%s and %s must be given", getParamHost, getParamIfIndex)
+		logRequestf(request, levelInfo, "error: %s", msg)
+		s.http400(response, msg)
+		return
+	}
+
+	flap, err := s.flapper.LatestFlap(request.Context(), q, time.Time{})
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+	if flap == nil {
+		s.httpError(response, http.StatusNotFound, "not_found", "no flaps of the port")
+		return
+	}
+
+	jsonResult, err := json.Marshal(PortStatusResult{IfOperStatus: flap.IfOperStatus, LastChange: flap.Time})
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.Write(jsonResult)
+}
+
+func (s *Server) HandleStatus(response http.ResponseWriter, request *http.Request) {
+
+	staleAfter := time.Duration(config.StaleCollectorSec) * time.Second
+	status, err := s.flapper.Health(request.Context(), staleAfter)
+
+	// An unreachable database is the answer, not a failure of the request
+	code := http.StatusOK
+	if err != nil {
+		if request.Context().Err() != nil {
+			s.httpQueryError(response, request, err)
+			return
+		}
+		logRequestf(request, levelWarn, "database is unhealthy: %s", err)
+		code = http.StatusServiceUnavailable
+	}
+
+	jsonResult, err := json.Marshal(status)
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	response.Header().Add("Content-Type", "application/json")
+	response.WriteHeader(code)
+	response.Write(jsonResult)
+}
+
+func (s *Server) HandleCheck(response http.ResponseWriter, request *http.Request, q QueryParams) {
+	logf(levelDebug, "?check requested")
+
+	result := CheckResult{CheckResult: "flapmyport"}
+
+	// A dashboard must not show the backend alive while its database is gone
+	code := http.StatusOK
+	if q.Deep {
+		result.DB = "ok"
+		if err := s.flapper.Ping(request.Context()); err != nil {
+			logRequestf(request, levelWarn, "database is unreachable: %s", err)
+			result.DB = "unreachable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	jsonResult, err := json.Marshal(result)
+	if err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+	if q.Deep {
+		response.Header().Add("Content-Type", "application/json")
+	}
+	response.WriteHeader(code)
+	response.Write(jsonResult)
+}
+
+func (s *Server) HandleFlapChart(response http.ResponseWriter, request *http.Request, queryParams QueryParams) {
+
+	if queryParams.Host == "" {
+		msg := fmt.Sprintf("%s not given", getParamHost)
+		logRequestf(request, levelInfo, "error: %s", msg)
+		s.http400(response, msg)
+		return
+	}
+	if !queryParams.End.After(queryParams.Start) {
+		logRequestf(request, levelInfo, "error: %s", errEmptyWindow)
+		s.http400(response, errEmptyWindow.Error())
+		return
+	}
+
+	// A chart only changes when a newer flap appears in its window.
+	// A host overview is identified before its ports are looked up.
+	etag := ""
+	latestFlapID, err := s.flapper.LatestFlapID(request.Context(), queryParams)
+	if isContextError(err) {
+		s.httpQueryError(response, request, err)
+		return
+
+	} else if err != nil {
+		logRequestf(request, levelWarn, "error: %s", err)
+
+	} else {
+		etag = flapChartETag(queryParams, latestFlapID)
+		response.Header().Set("ETag", etag)
+		response.Header().Set("Cache-Control", flapChartCacheControl(queryParams))
+
+		if etagMatches(request.Header.Get("If-None-Match"), etag) {
+			response.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if cached, ok := s.chartCache.Get(etag); ok {
+			if cached.truncated != "" {
+				response.Header().Set(headerFlapChartTruncated, cached.truncated)
+			}
+			response.Header().Set("Content-Type", cached.contentType)
+			response.Write(cached.body)
+			return
+		}
+	}
+
+	// Without an ifindex the chart shows the ports of the host that flapped
+	truncated := ""
+	if queryParams.IfIndex == 0 && len(queryParams.IfIndexes) == 0 {
+		ports, err := s.flapper.HostPorts(request.Context(), queryParams)
+		if err != nil {
+			s.httpQueryError(response, request, err)
+			return
+		}
+		if len(ports) == 0 {
+			s.httpError(response, http.StatusNotFound, "not_found", "no flaps of the host in the window")
+			return
+		}
+		if len(ports) > flapChartMaxStrips {
+			truncated = fmt.Sprintf("%d of %d ports shown", flapChartMaxStrips, len(ports))
+			response.Header().Set(headerFlapChartTruncated, truncated)
+			ports = ports[:flapChartMaxStrips]
+		}
+		for _, port := range ports {
+			queryParams.IfIndexes = append(queryParams.IfIndexes, port.IfIndex)
+			queryParams.labels = append(queryParams.labels, strings.TrimSpace(fmt.Sprintf("%s %s", port.IfName, port.IfAlias)))
+		}
+	}
+	stacked := len(queryParams.IfIndexes) > 0
+
+	var body bytes.Buffer
+	contentType := "image/png"
+
+	if queryParams.Format == formatJSON {
+		var timeline interface{}
+		if stacked {
+			timeline, err = s.flapper.PortTimelines(request.Context(), queryParams)
+		} else {
+			timeline, err = s.flapper.Timeline(request.Context(), queryParams)
+		}
+		if err != nil {
+			s.httpQueryError(response, request, err)
+			return
+		}
+
+		jsonTimeline, err := json.Marshal(timeline)
+		if err != nil {
+			logRequestf(request, levelError, "error: %s", err)
+			s.http500(response)
+			return
+		}
+		body.Write(jsonTimeline)
+		contentType = "application/json"
+
+	} else {
+		var flapChart *FlapsDiagram
+		if stacked {
+			flapChart, err = s.flapper.StackedFlapChart(request.Context(), queryParams)
+		} else {
+			flapChart, err = s.flapper.FlapChart(request.Context(), queryParams)
+		}
+		if err != nil {
+			s.httpQueryError(response, request, err)
+			return
+		}
+
+		if err := png.Encode(&body, flapChart.img); err != nil {
+			logRequestf(request, levelError, "error: %s", err)
+			s.http500(response)
+			return
+		}
+	}
+
+	if etag != "" {
+		s.chartCache.Add(chartCacheEntry{key: etag, contentType: contentType, body: body.Bytes(), truncated: truncated})
+	}
+
+	response.Header().Set("Content-Type", contentType)
+	response.Write(body.Bytes())
+}
+
+// HandleFlapCharts returns a ZIP archive with a chart per port of the host that flapped in the window
+func (s *Server) HandleFlapCharts(response http.ResponseWriter, request *http.Request, queryParams QueryParams) {
+
+	if queryParams.Host == "" {
+		msg := fmt.Sprintf("%s not given", getParamHost)
+		logRequestf(request, levelInfo, "error: %s", msg)
+		s.http400(response, msg)
+		return
+	}
+	if !queryParams.End.After(queryParams.Start) {
+		logRequestf(request, levelInfo, "error: %s", errEmptyWindow)
+		s.http400(response, errEmptyWindow.Error())
+		return
+	}
+
+	ports, err := s.flapper.HostPorts(request.Context(), queryParams)
+	if err != nil {
+		s.httpQueryError(response, request, err)
+		return
+	}
+	if len(ports) == 0 {
+		s.httpError(response, http.StatusNotFound, "not_found", "no flaps of the host in the window")
+		return
+	}
+	if len(ports) > flapChartMaxStrips {
+		response.Header().Set(headerFlapChartTruncated, fmt.Sprintf("%d of %d ports shown", flapChartMaxStrips, len(ports)))
+		ports = ports[:flapChartMaxStrips]
+	}
+
+	// The archive is built in memory, so a failed chart still gets an error response
+	var body bytes.Buffer
+	archive := zip.NewWriter(&body)
+	for _, port := range ports {
+		portQuery := queryParams
+		portQuery.IfIndex = port.IfIndex
+
+		flapChart, err := s.flapper.FlapChart(request.Context(), portQuery)
+		if err != nil {
+			s.httpQueryError(response, request, err)
+			return
+		}
+
+		file, err := archive.Create(fmt.Sprintf("ifindex-%d.png", port.IfIndex))
+		if err == nil {
+			err = png.Encode(file, flapChart.img)
+		}
+		if err != nil {
+			logRequestf(request, levelError, "error: %s", err)
+			s.http500(response)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		logRequestf(request, levelError, "error: %s", err)
+		s.http500(response)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/zip")
+	response.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("flapcharts-%s.zip", queryParams.Host),
+	}))
+	response.Write(body.Bytes())
+}
+
+// flapChartETag identifies a rendered chart by its window, size and newest flap
+func flapChartETag(q QueryParams, latestFlapID int) string {
+	ifIndexes := strconv.Itoa(q.IfIndex)
+	if len(q.IfIndexes) > 0 {
+		ifIndexes = strings.Trim(fmt.Sprint(q.IfIndexes), "[]")
+	}
+
+	width, height := q.chartSize()
+	key := fmt.Sprintf("%s|%s|%s|%s|%d|%d|%d|%d|%s|%t|%d",
+		q.Source,
+		q.Host,
+		ifIndexes,
+		strings.Join(q.labels, ","),
+		q.Start.Unix(),
+		q.End.Unix(),
+		width,
+		height,
+		q.Format,
+		q.IncludeSubIf,
+		latestFlapID,
+	)
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(key)))
+}
+
+// flapChartCacheControl lets historical charts be cached much longer than live ones
+func flapChartCacheControl(q QueryParams) string {
+	if time.Now().UTC().Sub(q.End) < flapChartLiveWindow {
+		return fmt.Sprintf("max-age=%d", flapChartLiveMaxAge)
+	}
+	return fmt.Sprintf("max-age=%d", flapChartStaticMaxAge)
+}
+
+// etagMatches checks an If-None-Match header value against an ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryBody is the JSON form of the query parameters accepted via POST
+type QueryBody struct {
+	Host            string `json:"host"`
+	IfIndex         *int   `json:"ifindex"`
+	Start           string `json:"start"`
+	End             string `json:"end"`
+	Interval        *int   `json:"interval"`
+	Filter          string `json:"filter"`
+	FilterMode      string `json:"filtermode"`
+	Format          string `json:"format"`
+	AfterID         *int   `json:"afterId"`
+	Limit           *int   `json:"limit"`
+	Offset          *int   `json:"offset"`
+	Count           *int   `json:"count"`
+	IncludeSubIf    bool   `json:"includesubif"`
+	GroupBy         string `json:"groupby"`
+	HideBlacklisted bool   `json:"hideblacklisted"`
+	Bucket          string `json:"bucket"`
+	TopN            *int   `json:"topn"`
+	TopBy           string `json:"by"`
+	MaxHosts        *int   `json:"maxhosts"`
+	Source          string `json:"source"`
+	IncludeSid      bool   `json:"includesid"`
+	MinTransitions  *int   `json:"mintransitions"`
+	Status          string `json:"status"`
+	DebounceMs      *int   `json:"debounceMs"`
+	Width           *int   `json:"width"`
+	Height          *int   `json:"height"`
+}
+
+// Values converts the body to the query string form ParseQueryParams reads
+func (b QueryBody) Values() url.Values {
+	v := url.Values{}
+
+	if b.Host != "" {
+		v.Set(getParamHost, b.Host)
+	}
+	if b.IfIndex != nil {
+		v.Set(getParamIfIndex, strconv.Itoa(*b.IfIndex))
+	}
+	if b.Start != "" {
+		v.Set(getParamStartTime, b.Start)
+	}
+	if b.End != "" {
+		v.Set(getParamEndTime, b.End)
+	}
+	if b.Interval != nil {
+		v.Set(getParamInterval, strconv.Itoa(*b.Interval))
+	}
+	if b.Filter != "" {
+		v.Set(getParamFilter, b.Filter)
+	}
+	if b.FilterMode != "" {
+		v.Set(getParamFilterMode, b.FilterMode)
+	}
+	if b.Format != "" {
+		v.Set(getParamFormat, b.Format)
+	}
+	if b.AfterID != nil {
+		v.Set(getParamAfterID, strconv.Itoa(*b.AfterID))
+	}
+	if b.Limit != nil {
+		v.Set(getParamLimit, strconv.Itoa(*b.Limit))
+	}
+	if b.Offset != nil {
+		v.Set(getParamOffset, strconv.Itoa(*b.Offset))
+	}
+	if b.Count != nil {
+		v.Set(getParamCount, strconv.Itoa(*b.Count))
+	}
+	if b.IncludeSubIf {
+		v.Set(getParamIncludeSubIf, "true")
+	}
+	if b.GroupBy != "" {
+		v.Set(getParamGroupBy, b.GroupBy)
+	}
+	if b.HideBlacklisted {
+		v.Set(getParamHideBlacklisted, "true")
+	}
+	if b.Bucket != "" {
+		v.Set(getParamBucket, b.Bucket)
+	}
+	if b.TopN != nil {
+		v.Set(getParamTopN, strconv.Itoa(*b.TopN))
+	}
+	if b.TopBy != "" {
+		v.Set(getParamTopBy, b.TopBy)
+	}
+	if b.MaxHosts != nil {
+		v.Set(getParamMaxHosts, strconv.Itoa(*b.MaxHosts))
+	}
+	if b.Source != "" {
+		v.Set(getParamSource, b.Source)
+	}
+	if b.IncludeSid {
+		v.Set(getParamIncludeSid, "true")
+	}
+	if b.MinTransitions != nil {
+		v.Set(getParamMinTransitions, strconv.Itoa(*b.MinTransitions))
+	}
+	if b.Status != "" {
+		v.Set(getParamStatus, b.Status)
+	}
+	if b.DebounceMs != nil {
+		v.Set(getParamDebounceMs, strconv.Itoa(*b.DebounceMs))
+	}
+	if b.Width != nil {
+		v.Set(getParamWidth, strconv.Itoa(*b.Width))
+	}
+	if b.Height != nil {
+		v.Set(getParamHeight, strconv.Itoa(*b.Height))
+	}
+	return v
+}
+
+// parseFlag reads a boolean parameter; a bare "?flag" means true
+func parseFlag(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func isJSONContent(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// queryAction returns the action named by the keys of the query string.
+// route needs it before the parameters are parsed, to exempt ?check from auth.
+func queryAction(query url.Values) string {
+	action := ""
+
+	if _, ok := query[actionCheck]; ok {
+		action = actionCheck
+	}
+
+	if _, ok := query[actionReview]; ok {
+		action = actionReview
+	}
+
+	if _, ok := query[actionFlapHistory]; ok {
+		action = actionFlapHistory
+	}
+
+	if _, ok := query[actionEvents]; ok {
+		action = actionEvents
+	}
+
+	if _, ok := query[actionStream]; ok {
+		action = actionStream
+	}
+
+	if _, ok := query[actionFlapChart]; ok {
+		action = actionFlapChart
+	}
+
+	if _, ok := query[actionFlapCharts]; ok {
+		action = actionFlapCharts
+	}
+
+	if _, ok := query[actionHosts]; ok {
+		action = actionHosts
+	}
+
+	if _, ok := query[actionInterfaces]; ok {
+		action = actionInterfaces
+	}
+
+	if _, ok := query[actionRecent]; ok {
+		action = actionRecent
+	}
+
+	if _, ok := query[actionStats]; ok {
+		action = actionStats
+	}
+
+	if _, ok := query[actionAliasStats]; ok {
+		action = actionAliasStats
+	}
+
+	// status is also a review parameter, e.g. ?review&status=down
+	if _, ok := query[actionStatus]; ok && action == "" {
+		action = actionStatus
+	}
+
+	if _, ok := query[actionPortStatus]; ok {
+		action = actionPortStatus
+	}
+	return action
+}
+
+// errBodyTooLarge is returned for a POST body longer than MaxBodyBytes
+var errBodyTooLarge = errors.New("request body too large")
+
+func (s *Server) ParseQueryParams(request *http.Request) (QueryParams, error) {
+
+	queryParams := QueryParams{
+		Start: time.Now().UTC().Add(-defaultReviewInterval),
+		End:   time.Now().UTC(),
+		Filter: Filter{
+			Conditions: []string{},
+		},
+	}
+
+	query := request.URL.Query()
+
+	queryParams.action = queryAction(query)
+
+	// Parameters may come in a JSON body instead of the query string
+	if request.Method == http.MethodPost && isJSONContent(request) {
+		// The body is read through http.MaxBytesReader, which fails past MaxBodyBytes
+		data, err := io.ReadAll(request.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logRequestf(request, levelInfo, "error: body exceeds %d bytes", config.MaxBodyBytes)
+			return queryParams, errBodyTooLarge
+		}
+		if err != nil {
+			logRequestf(request, levelInfo, "error reading body: %s", err)
+			return queryParams, fmt.Errorf("error reading body: %s", err)
+		}
+
+		body := QueryBody{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			logRequestf(request, levelInfo, "invalid JSON body: %s", err)
+			return queryParams, fmt.Errorf("invalid JSON body: %s", err)
+		}
+		query = body.Values()
+	}
+
+	if ifIndexStr, ok := query[getParamIfIndex]; ok {
+		if strings.Contains(ifIndexStr[0], ",") {
+			for _, item := range splitList(ifIndexStr[0]) {
+				ifIndex, err := strconv.Atoi(item)
+				if err != nil {
+					logRequestf(request, levelInfo, "invalid %s: %s", getParamIfIndex, ifIndexStr[0])
+					return queryParams, fmt.Errorf("invalid %s", getParamIfIndex)
+				}
+				queryParams.IfIndexes = append(queryParams.IfIndexes, ifIndex)
+			}
+			if len(queryParams.IfIndexes) == 1 {
+				queryParams.IfIndex = queryParams.IfIndexes[0]
+				queryParams.IfIndexes = nil
+			}
+		} else if ifIndexStr[0] != "" {
+			ifIndex, err := strconv.Atoi(ifIndexStr[0])
+			if err != nil {
+				logRequestf(request, levelInfo, "invalid %s: %s", getParamIfIndex, ifIndexStr[0])
+				return queryParams, fmt.Errorf("invalid %s", getParamIfIndex)
+			}
+			queryParams.IfIndex = ifIndex
+		}
+	}
+
+	if host, ok := query[getParamHost]; ok {
+		if strings.Contains(host[0], ",") {
+			if queryParams.action != actionReview {
+				logRequestf(request, levelInfo, "%s list for ?%s", getParamHost, queryParams.action)
+				return queryParams, fmt.Errorf("a %s list is only accepted by ?%s", getParamHost, actionReview)
+			}
+			for _, item := range splitList(host[0]) {
+				if net.ParseIP(item) == nil {
+					logRequestf(request, levelInfo, "invalid %s: %s", getParamHost, item)
+					return queryParams, fmt.Errorf("invalid %s %q, a list takes IP addresses", getParamHost, item)
+				}
+				queryParams.Hosts = append(queryParams.Hosts, item)
+			}
+		} else {
+			queryParams.Host = host[0]
+		}
+	}
+
+	if source, ok := query[getParamSource]; ok && source[0] != "" {
+		if _, ok := s.flappers[source[0]]; !ok {
+			logRequestf(request, levelInfo, "unknown %s: %s", getParamSource, source[0])
+			return queryParams, fmt.Errorf("unknown %s %q", getParamSource, source[0])
+		}
+		queryParams.Source = source[0]
+	}
+
+	if format, ok := query[getParamFormat]; ok {
+		queryParams.Format = format[0]
+	}
+
+	if includeSubIfStr, ok := query[getParamIncludeSubIf]; ok {
+		includeSubIf, err := parseFlag(includeSubIfStr[0])
+		if err != nil {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamIncludeSubIf, includeSubIfStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamIncludeSubIf)
+		}
+		queryParams.IncludeSubIf = includeSubIf
+	}
+
+	if includeSidStr, ok := query[getParamIncludeSid]; ok {
+		includeSid, err := parseFlag(includeSidStr[0])
+		if err != nil {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamIncludeSid, includeSidStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamIncludeSid)
+		}
+		queryParams.IncludeSid = includeSid
+	}
+
+	if deepStr, ok := query[getParamDeep]; ok {
+		deep, err := parseFlag(deepStr[0])
+		if err != nil {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamDeep, deepStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamDeep)
+		}
+		queryParams.Deep = deep
+	}
+
+	if hideStr, ok := query[getParamHideBlacklisted]; ok {
+		hide, err := parseFlag(hideStr[0])
+		if err != nil {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamHideBlacklisted, hideStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamHideBlacklisted)
+		}
+		queryParams.HideBlacklisted = hide
+	}
+
+	if status, ok := query[getParamStatus]; ok && status[0] != "" && queryParams.action != actionStatus {
+		if status[0] != ifStatusUpCaption && status[0] != ifStatusDownCaption {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamStatus, status[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamStatus)
+		}
+		queryParams.Status = status[0]
+	}
+
+	if groupBy, ok := query[getParamGroupBy]; ok && groupBy[0] != "" {
+		if groupBy[0] != groupByAlias {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamGroupBy, groupBy[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamGroupBy)
+		}
+		queryParams.GroupBy = groupBy[0]
+	}
+
+	queryParams.Bucket = statsBucketHour
+	if bucket, ok := query[getParamBucket]; ok && bucket[0] != "" {
+		if bucket[0] != statsBucketHour && bucket[0] != statsBucketDay {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamBucket, bucket[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamBucket)
+		}
+		queryParams.Bucket = bucket[0]
+	}
+
+	if topNStr, ok := query[getParamTopN]; ok {
+		topN, err := strconv.Atoi(topNStr[0])
+		if err != nil || topN < 1 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamTopN, topNStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamTopN)
+		}
+		if topN > maxStatsTopN {
+			topN = maxStatsTopN
+		}
+		queryParams.TopN = topN
+	}
+
+	queryParams.TopBy = statsTopByHost
+	if topBy, ok := query[getParamTopBy]; ok && topBy[0] != "" {
+		if topBy[0] != statsTopByHost && topBy[0] != statsTopByPort {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamTopBy, topBy[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamTopBy)
+		}
+		queryParams.TopBy = topBy[0]
+	}
+
+	if afterIDStr, ok := query[getParamAfterID]; ok {
+		afterID, err := strconv.Atoi(afterIDStr[0])
+		if err != nil || afterID < 0 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamAfterID, afterIDStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamAfterID)
+		}
+		queryParams.AfterID = afterID
+	}
+
+	if limitStr, ok := query[getParamLimit]; ok {
+		limit, err := strconv.Atoi(limitStr[0])
+		if err != nil || limit < 1 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamLimit, limitStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamLimit)
+		}
+		if limit > maxFlapHistoryLimit {
+			limit = maxFlapHistoryLimit
+		}
+		queryParams.Limit = limit
+	}
+
+	if offsetStr, ok := query[getParamOffset]; ok {
+		offset, err := strconv.Atoi(offsetStr[0])
+		if err != nil || offset < 0 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamOffset, offsetStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamOffset)
+		}
+		queryParams.Offset = offset
+	}
+
+	if countStr, ok := query[getParamCount]; ok {
+		count, err := strconv.Atoi(countStr[0])
+		if err != nil || count < 1 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamCount, countStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamCount)
+		}
+		queryParams.Count = count
+	}
+
+	if minTransitionsStr, ok := query[getParamMinTransitions]; ok {
+		minTransitions, err := strconv.Atoi(minTransitionsStr[0])
+		if err != nil || minTransitions < 1 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamMinTransitions, minTransitionsStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamMinTransitions)
+		}
+		queryParams.MinTransitions = minTransitions
+	}
+
+	if debounceStr, ok := query[getParamDebounceMs]; ok {
+		debounceMs, err := strconv.Atoi(debounceStr[0])
+		if err != nil || debounceMs < 0 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamDebounceMs, debounceStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamDebounceMs)
+		}
+		queryParams.Debounce = time.Duration(debounceMs) * time.Millisecond
+	}
+
+	if maxHostsStr, ok := query[getParamMaxHosts]; ok {
+		maxHosts, err := strconv.Atoi(maxHostsStr[0])
+		if err != nil || maxHosts < 1 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamMaxHosts, maxHostsStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamMaxHosts)
+		}
+		queryParams.MaxHosts = maxHosts
+	}
+
+	// The image is allocated at this size, it must be checked before anything is drawn.
+	// Columns are spread over width-1 intervals, so there are at least two.
+	if widthStr, ok := query[getParamWidth]; ok {
+		width, err := strconv.Atoi(widthStr[0])
+		if err != nil || width < 2 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamWidth, widthStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamWidth)
+		}
+		if width > config.MaxChartWidth {
+			logRequestf(request, levelInfo, "%s %d exceeds %d", getParamWidth, width, config.MaxChartWidth)
+			return queryParams, fmt.Errorf("%s exceeds the limit of %d", getParamWidth, config.MaxChartWidth)
+		}
+		queryParams.Width = width
+	}
+
+	if heightStr, ok := query[getParamHeight]; ok {
+		height, err := strconv.Atoi(heightStr[0])
+		if err != nil || height < 1 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamHeight, heightStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamHeight)
+		}
+		if height > config.MaxChartHeight {
+			logRequestf(request, levelInfo, "%s %d exceeds %d", getParamHeight, height, config.MaxChartHeight)
+			return queryParams, fmt.Errorf("%s exceeds the limit of %d", getParamHeight, config.MaxChartHeight)
+		}
+		queryParams.Height = height
+	}
+
+	if startStr, ok := query[getParamStartTime]; ok {
+		if startStr[0] != "" {
+			if start, err := time.Parse(timeFormat, startStr[0]); err != nil {
+				logRequestf(request, levelInfo, "invalid start time: %s", err)
+				return queryParams, err
+			} else {
+				queryParams.Start = start
+			}
+		}
+	}
+
+	if endStr, ok := query[getParamEndTime]; ok {
+		if endStr[0] != "" {
+			if end, err := time.Parse(timeFormat, endStr[0]); err != nil {
+				logRequestf(request, levelInfo, "invalid end time: %s", err)
+				return queryParams, err
+			} else {
+				queryParams.End = end
+			}
+		}
+	}
+
+	// `start` and `end` are overwritten if `interval` is provided
+	if intervalStr, ok := query[getParamInterval]; ok {
+		interval, err := strconv.Atoi(intervalStr[0])
+		if err != nil || interval < 0 {
+			logRequestf(request, levelInfo, "invalid %s: %s", getParamInterval, intervalStr[0])
+			return queryParams, fmt.Errorf("invalid %s", getParamInterval)
+		}
+		duration := time.Duration(interval) * time.Second
+		queryParams.End = time.Now().UTC()
+		queryParams.Start = queryParams.End.Add(-duration)
+	}
+
+	// Sources may differ in their database, the filter is compiled for the one queried
+	source := s.forSource(queryParams).flapper
+	if err := queryParams.Filter.ParseFilter(query, source.columns, source.dialect); err != nil {
+		logRequestf(request, levelInfo, "invalid filter: %s", err)
+		return queryParams, err
+	}
+
+	return queryParams, nil
+}
+
+// setCORSHeaders allows browsers on configured origins to read responses
+func (s *Server) setCORSHeaders(response http.ResponseWriter, request *http.Request) {
+	origin := request.Header.Get("Origin")
+	if origin == "" || len(config.AllowedOrigins) == 0 {
+		return
+	}
+
+	allowed := ""
+	for _, allowedOrigin := range config.AllowedOrigins {
+		if allowedOrigin == "*" {
+			allowed = "*"
+			break
+		}
+		if allowedOrigin == origin {
+			allowed = origin
+		}
+	}
+	if allowed == "" {
+		return
+	}
+
+	header := response.Header()
+	header.Set("Access-Control-Allow-Origin", allowed)
+	if allowed != "*" {
+		header.Add("Vary", "Origin")
+	}
+	header.Set("Access-Control-Expose-Headers", "ETag, Retry-After, "+headerFlapChartTruncated+", "+headerRequestID+", "+headerAPIVersion)
+
+	if request.Method == http.MethodOptions {
+		header.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		header.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+headerAPIKey)
+		header.Set("Access-Control-Max-Age", "86400")
+	}
+}
+
+// apiVersionRe matches the media types pinning a version of the responses
+var apiVersionRe = regexp.MustCompile(`^application/vnd\.flapmyport\.v(\d+)\+json$`)
+
+// acceptsAPIVersion tells whether a request pinning versions in Accept takes the current one.
+// Requests without a pinned version take any.
+func acceptsAPIVersion(request *http.Request) bool {
+	pinned := false
+	for _, accept := range request.Header.Values("Accept") {
+		for _, item := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(item))
+			if err != nil {
+				continue
+			}
+			match := apiVersionRe.FindStringSubmatch(mediaType)
+			if match == nil {
+				continue
+			}
+			if match[1] == strconv.Itoa(apiVersion) {
+				return true
+			}
+			pinned = true
+		}
+	}
+	return !pinned
+}
+
+func (s Server) http406(response http.ResponseWriter) {
+	message := fmt.Sprintf("Only API version %d is available", apiVersion)
+	s.httpError(response, http.StatusNotAcceptable, "not_acceptable", message)
+}
+
+func (s *Server) route(response http.ResponseWriter, request *http.Request) {
+
+	s.setCORSHeaders(response, request)
+	response.Header().Set(headerAPIVersion, strconv.Itoa(apiVersion))
+
+	if request.Method == http.MethodOptions {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !acceptsAPIVersion(request) {
+		logRequestf(request, levelInfo, "error: unsupported API version in Accept: %s", request.Header.Get("Accept"))
+		s.http406(response)
+		return
+	}
+
+	// Clients are let in before anything they sent is parsed
+	action := queryAction(request.URL.Query())
+
+	if action != actionCheck && s.limiter != nil {
+		if ok, retryAfter := s.limiter.Allow(clientIP(request)); !ok {
+			logRequestf(request, levelDebug, "%s rate limited", clientIP(request))
+			s.http429(response, retryAfter)
+			return
+		}
+	}
+
+	if action != actionCheck && !s.authorized(request) {
+		logRequestf(request, levelInfo, "error: invalid or missing credentials")
+		s.http401(response)
+		return
+	}
+
+	// A huge body must not be held in memory while it is decoded
+	request.Body = http.MaxBytesReader(response, request.Body, int64(config.MaxBodyBytes))
+
+	queryParams, err := s.ParseQueryParams(request)
+	if err == errBodyTooLarge {
+		s.httpError(response, http.StatusRequestEntityTooLarge, "body_too_large",
+			fmt.Sprintf("Request body exceeds %d bytes", config.MaxBodyBytes))
+		return
+	}
+	if err != nil {
+		logRequestf(request, levelInfo, "ParseQueryParams error: %s", err)
+		s.http400(response, err.Error())
+		return
+	}
+
+	logRequestf(request, levelDebug, "/%s requested", queryParams.action)
+
+	s = s.forSource(queryParams)
+
+	// Cheap actions like ?check and ?status are answered however busy the database is
+	if s.queries != nil && expensiveActions[queryParams.action] {
+		if !s.queries.Acquire(request.Context()) {
+			logRequestf(request, levelWarn, "error: %d queries running, none finished within %ds",
+				config.MaxConcurrentQueries, config.QueryQueueSec)
+			response.Header().Set("Retry-After", "1")
+			s.httpError(response, http.StatusServiceUnavailable, "busy", "Too many queries running, try again later")
+			return
+		}
+		defer s.queries.Release()
+	}
+
+	// Devices are better known by name than by address, an address needs no lookup
+	if queryParams.Host != "" && net.ParseIP(queryParams.Host) == nil {
+		host, err := s.flapper.ResolveHost(request.Context(), queryParams.Host)
+		var ambiguous AmbiguousHostError
+		if errors.As(err, &ambiguous) {
+			logRequestf(request, levelInfo, "error: %s", err)
+			s.http400(response, err.Error())
+			return
+		} else if err != nil {
+			s.httpQueryError(response, request, err)
+			return
+		}
+		queryParams.Host = host
+	}
+
+	switch queryParams.action {
+
+	case actionReview:
+		s.HandleReview(response, request, queryParams)
+
+	case actionFlapChart:
+		s.HandleFlapChart(response, request, queryParams)
+
+	case actionFlapCharts:
+		s.HandleFlapCharts(response, request, queryParams)
+
+	case actionFlapHistory:
+		s.HandleFlapHistory(response, request, queryParams)
+
+	case actionEvents:
+		s.HandleEvents(response, request, queryParams)
+
+	case actionStream:
+		s.HandleStream(response, request, queryParams)
+
+	case actionHosts:
+		s.HandleHosts(response, request, queryParams)
+
+	case actionInterfaces:
+		s.HandleInterfaces(response, request, queryParams)
+
+	case actionRecent:
+		s.HandleRecent(response, request, queryParams)
+
+	case actionStats:
+		s.HandleStats(response, request, queryParams)
+
+	case actionAliasStats:
+		s.HandleAliasStats(response, request, queryParams)
+
+	case actionStatus:
+		s.HandleStatus(response, request)
+
+	case actionPortStatus:
+		s.HandlePortStatus(response, request, queryParams)
+
+	case actionCheck:
+		s.HandleCheck(response, request, queryParams)
+
+	default:
+		s.Index(response, request)
+	}
+
+}
+
+// ACCESS LOG
+
+// responseWriter remembers the status and size of a response
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush lets streamed answers through the access log
+func (w *responseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type requestIDKey struct{}
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]+$`)
+
+// requestID takes the id a proxy gave the request or makes a new one
+func requestID(request *http.Request) string {
+	id := request.Header.Get(headerRequestID)
+	if id != "" && len(id) <= 64 && requestIDRe.MatchString(id) {
+		return id
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// logContextf prefixes a log line with the id of the request being served
+func logContextf(ctx context.Context, level int, format string, v ...interface{}) {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok && id != "" {
+		format = "[" + id + "] " + format
+	}
+	logf(level, format, v...)
+}
+
+func logRequestf(request *http.Request, level int, format string, v ...interface{}) {
+	logContextf(request.Context(), level, "%s "+format, append([]interface{}{loggedURL(request.URL)}, v...)...)
+}
+
+// loggedURL is the URL as it's logged, with the API key masked
+func loggedURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(name); err == nil && name == getParamKey {
+			params[i] = getParamKey + "=REDACTED"
+		}
+	}
+	return u.Path + "?" + strings.Join(params, "&")
+}
+
+// logRequests tags a request with an id and writes an access log line for it.
+// Failed requests are always logged, successful ones only in verbose mode.
+func logRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		started := time.Now()
+		recorder := &responseWriter{ResponseWriter: response}
+
+		id := requestID(request)
+		response.Header().Set(headerRequestID, id)
+		request = request.WithContext(context.WithValue(request.Context(), requestIDKey{}, id))
+
+		next(recorder, request)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		// 304 is the expected answer to a conditional request, not a failure
+		failed := (recorder.status < 200 || recorder.status >= 300) && recorder.status != http.StatusNotModified
+		level := levelDebug
+		if failed {
+			level = levelInfo
+		}
+
+		logContextf(request.Context(), level, "%s %s %s %d %dB %s",
+			clientIP(request),
+			request.Method,
+			loggedURL(request.URL),
+			recorder.status,
+			recorder.bytes,
+			time.Since(started),
+		)
+	}
+}
+
+func readConfigFile(file *string) {
+	if _, err := toml.DecodeFile(*file, &config); err != nil {
+		msg := fmt.Sprintf("%s not found. Suppose we're using environment variables", *file)
+		fmt.Println(msg)
+		logf(levelInfo, "%s", msg)
+	}
+}
+
+func readConfigEnv() {
+
+	if logFilename, exists := os.LookupEnv("LOGFILE"); exists {
+		config.LogFilename = logFilename
+	}
+
+	if listenAddress, exists := os.LookupEnv("LISTEN_ADDRESS"); exists {
+		config.ListenAddress = listenAddress
+	}
+
+	if listenPort, exists := os.LookupEnv("LISTEN_PORT"); exists {
+		if intPort, error := strconv.Atoi(listenPort); error != nil {
+			msg := "Wrong environment variable LISTEN_PORT"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.ListenPort = intPort
+		}
+
+	}
+
+	if listenSocket, exists := os.LookupEnv("LISTEN_SOCKET"); exists {
+		config.ListenSocket = listenSocket
+	}
+
+	if dbDriver, exists := os.LookupEnv("DBDRIVER"); exists {
+		config.DBDriver = dbDriver
+	}
+
+	if dbFixture, exists := os.LookupEnv("DBFIXTURE"); exists {
+		config.DBFixture = dbFixture
+	}
+
+	if dbHost, exists := os.LookupEnv("DBHOST"); exists {
+		config.DBHost = dbHost
+	}
+
+	if dbName, exists := os.LookupEnv("DBNAME"); exists {
+		config.DBName = dbName
+	}
+
+	if dbUser, exists := os.LookupEnv("DBUSER"); exists {
+		config.DBUser = dbUser
+	}
+
+	if dbPassword, exists := os.LookupEnv("DBPASSWORD"); exists {
+		config.DBPassword = dbPassword
+	}
+
+	if dbPasswordFile, exists := os.LookupEnv("DBPASSWORD_FILE"); exists {
+		config.DBPasswordFile = dbPasswordFile
+	}
+
+	if dbTLS, exists := os.LookupEnv("DB_TLS"); exists {
+		config.DBTLS = dbTLS
+	}
+
+	if dbSSLMode, exists := os.LookupEnv("DB_SSLMODE"); exists {
+		config.DBSSLMode = dbSSLMode
+	}
+
+	if dbTLSCA, exists := os.LookupEnv("DB_TLS_CA"); exists {
+		config.DBTLSCA = dbTLSCA
+	}
+
+	if dbTLSCert, exists := os.LookupEnv("DB_TLS_CERT"); exists {
+		config.DBTLSCert = dbTLSCert
+	}
+
+	if dbTLSKey, exists := os.LookupEnv("DB_TLS_KEY"); exists {
+		config.DBTLSKey = dbTLSKey
+	}
+
+	if dbTable, exists := os.LookupEnv("DBTABLE"); exists {
+		config.DBTable = dbTable
+	}
+
+	if extendedColumns, exists := os.LookupEnv("DB_EXTENDED_COLUMNS"); exists {
+		if boolExtended, error := strconv.ParseBool(extendedColumns); error != nil {
+			msg := "Wrong environment variable DB_EXTENDED_COLUMNS"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.DBExtendedColumns = boolExtended
+		}
+	}
+
+	if queryTimeout, exists := os.LookupEnv("QUERY_TIMEOUT_SEC"); exists {
+		if intTimeout, error := strconv.Atoi(queryTimeout); error != nil {
+			msg := "Wrong environment variable QUERY_TIMEOUT_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.QueryTimeoutSec = intTimeout
+		}
+	}
+
+	if readTimeout, exists := os.LookupEnv("READ_TIMEOUT_SEC"); exists {
+		if intTimeout, error := strconv.Atoi(readTimeout); error != nil {
+			msg := "Wrong environment variable READ_TIMEOUT_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.ReadTimeoutSec = intTimeout
+		}
+	}
+
+	if writeTimeout, exists := os.LookupEnv("WRITE_TIMEOUT_SEC"); exists {
+		if intTimeout, error := strconv.Atoi(writeTimeout); error != nil {
+			msg := "Wrong environment variable WRITE_TIMEOUT_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.WriteTimeoutSec = intTimeout
+		}
+	}
+
+	if idleTimeout, exists := os.LookupEnv("IDLE_TIMEOUT_SEC"); exists {
+		if intTimeout, error := strconv.Atoi(idleTimeout); error != nil {
+			msg := "Wrong environment variable IDLE_TIMEOUT_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.IdleTimeoutSec = intTimeout
+		}
+	}
+
+	if connMaxIdle, exists := os.LookupEnv("DB_CONN_MAX_IDLE_SEC"); exists {
+		if intIdle, error := strconv.Atoi(connMaxIdle); error != nil {
+			msg := "Wrong environment variable DB_CONN_MAX_IDLE_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.DBConnMaxIdleSec = intIdle
+		}
+	}
+
+	if keepalive, exists := os.LookupEnv("DB_KEEPALIVE_SEC"); exists {
+		if intKeepalive, error := strconv.Atoi(keepalive); error != nil {
+			msg := "Wrong environment variable DB_KEEPALIVE_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.DBKeepaliveSec = intKeepalive
+		}
+	}
+
+	if maxWindow, exists := os.LookupEnv("MAX_WINDOW_HOURS"); exists {
+		if intWindow, error := strconv.Atoi(maxWindow); error != nil {
+			msg := "Wrong environment variable MAX_WINDOW_HOURS"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxWindowHours = intWindow
+		}
+	}
+
+	if rateLimit, exists := os.LookupEnv("RATE_LIMIT"); exists {
+		if floatLimit, error := strconv.ParseFloat(rateLimit, 64); error != nil {
+			msg := "Wrong environment variable RATE_LIMIT"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.RateLimit = floatLimit
+		}
+	}
+
+	if rateBurst, exists := os.LookupEnv("RATE_BURST"); exists {
+		if intBurst, error := strconv.Atoi(rateBurst); error != nil {
+			msg := "Wrong environment variable RATE_BURST"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.RateBurst = intBurst
+		}
+	}
+
+	if trustProxy, exists := os.LookupEnv("TRUST_PROXY"); exists {
+		if boolTrust, error := strconv.ParseBool(trustProxy); error != nil {
+			msg := "Wrong environment variable TRUST_PROXY"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.TrustProxy = boolTrust
+		}
+	}
+
+	if trustedProxies, exists := os.LookupEnv("TRUSTED_PROXIES"); exists {
+		config.TrustedProxies = splitList(trustedProxies)
+	}
+
+	if tlsCertFile, exists := os.LookupEnv("TLS_CERT_FILE"); exists {
+		config.TLSCertFile = tlsCertFile
+	}
+
+	if tlsKeyFile, exists := os.LookupEnv("TLS_KEY_FILE"); exists {
+		config.TLSKeyFile = tlsKeyFile
+	}
+
+	if excludeIfNames, exists := os.LookupEnv("EXCLUDE_IFNAMES"); exists {
+		config.ExcludeIfNames = splitList(excludeIfNames)
+	}
+
+	if flapThreshold, exists := os.LookupEnv("FLAP_THRESHOLD"); exists {
+		if intThreshold, error := strconv.Atoi(flapThreshold); error != nil {
+			msg := "Wrong environment variable FLAP_THRESHOLD"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.FlapThreshold = intThreshold
+		}
+	}
+
+	if maxRecent, exists := os.LookupEnv("MAX_RECENT_FLAPS"); exists {
+		if intMaxRecent, error := strconv.Atoi(maxRecent); error != nil {
+			msg := "Wrong environment variable MAX_RECENT_FLAPS"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxRecentFlaps = intMaxRecent
+		}
+	}
+
+	if coverageScope, exists := os.LookupEnv("COVERAGE_SCOPE"); exists {
+		config.CoverageScope = coverageScope
+	}
+
+	if chartColumnState, exists := os.LookupEnv("CHART_COLUMN_STATE"); exists {
+		config.ChartColumnState = chartColumnState
+	}
+
+	if timeFormat, exists := os.LookupEnv("TIME_FORMAT"); exists {
+		config.TimeFormat = timeFormat
+	}
+
+	if minTransitions, exists := os.LookupEnv("MIN_TRANSITIONS"); exists {
+		if intMinTransitions, error := strconv.Atoi(minTransitions); error != nil {
+			msg := "Wrong environment variable MIN_TRANSITIONS"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MinTransitions = intMinTransitions
+		}
+	}
+
+	if staleCollector, exists := os.LookupEnv("STALE_COLLECTOR_SEC"); exists {
+		if intStaleCollector, error := strconv.Atoi(staleCollector); error != nil {
+			msg := "Wrong environment variable STALE_COLLECTOR_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.StaleCollectorSec = intStaleCollector
+		}
+	}
+
+	if recentlyActive, exists := os.LookupEnv("RECENTLY_ACTIVE_SEC"); exists {
+		if intRecentlyActive, error := strconv.Atoi(recentlyActive); error != nil {
+			msg := "Wrong environment variable RECENTLY_ACTIVE_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.RecentlyActiveSec = intRecentlyActive
+		}
+	}
+
+	if reviewCacheTTL, exists := os.LookupEnv("REVIEW_CACHE_TTL_SEC"); exists {
+		if intReviewCacheTTL, error := strconv.Atoi(reviewCacheTTL); error != nil {
+			msg := "Wrong environment variable REVIEW_CACHE_TTL_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.ReviewCacheTTLSec = intReviewCacheTTL
+		}
+	}
+
+	if streamPoll, exists := os.LookupEnv("STREAM_POLL_SEC"); exists {
+		if intStreamPoll, error := strconv.Atoi(streamPoll); error != nil {
+			msg := "Wrong environment variable STREAM_POLL_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.StreamPollSec = intStreamPoll
+		}
+	}
+
+	if maxStreams, exists := os.LookupEnv("MAX_STREAMS"); exists {
+		if intMaxStreams, error := strconv.Atoi(maxStreams); error != nil {
+			msg := "Wrong environment variable MAX_STREAMS"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxStreams = intMaxStreams
+		}
+	}
+
+	if maxChartWidth, exists := os.LookupEnv("MAX_CHART_WIDTH"); exists {
+		if intMaxChartWidth, error := strconv.Atoi(maxChartWidth); error != nil {
+			msg := "Wrong environment variable MAX_CHART_WIDTH"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxChartWidth = intMaxChartWidth
+		}
+	}
+
+	if maxChartHeight, exists := os.LookupEnv("MAX_CHART_HEIGHT"); exists {
+		if intMaxChartHeight, error := strconv.Atoi(maxChartHeight); error != nil {
+			msg := "Wrong environment variable MAX_CHART_HEIGHT"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxChartHeight = intMaxChartHeight
+		}
+	}
+
+	if maxBodyBytes, exists := os.LookupEnv("MAX_BODY_BYTES"); exists {
+		if intMaxBodyBytes, error := strconv.Atoi(maxBodyBytes); error != nil {
+			msg := "Wrong environment variable MAX_BODY_BYTES"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxBodyBytes = intMaxBodyBytes
+		}
+	}
+
+	if maxQueries, exists := os.LookupEnv("MAX_CONCURRENT_QUERIES"); exists {
+		if intMaxQueries, error := strconv.Atoi(maxQueries); error != nil {
+			msg := "Wrong environment variable MAX_CONCURRENT_QUERIES"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxConcurrentQueries = intMaxQueries
+		}
+	}
+
+	if queryQueue, exists := os.LookupEnv("QUERY_QUEUE_SEC"); exists {
+		if intQueryQueue, error := strconv.Atoi(queryQueue); error != nil {
+			msg := "Wrong environment variable QUERY_QUEUE_SEC"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.QueryQueueSec = intQueryQueue
+		}
+	}
+
+	if logLevel, exists := os.LookupEnv("LOG_LEVEL"); exists {
+		config.LogLevel = logLevel
+	}
+
+	if bannerText, exists := os.LookupEnv("BANNER_TEXT"); exists {
+		config.BannerText = bannerText
+	}
+
+	if instanceEnv, exists := os.LookupEnv("INSTANCE_ENV"); exists {
+		config.InstanceEnv = instanceEnv
+	}
+
+	if discoveryLimit, exists := os.LookupEnv("DISCOVERY_LIMIT"); exists {
+		if intDiscoveryLimit, error := strconv.Atoi(discoveryLimit); error != nil {
+			msg := "Wrong environment variable DISCOVERY_LIMIT"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.DiscoveryLimit = intDiscoveryLimit
+		}
+	}
+
+	if maxHosts, exists := os.LookupEnv("MAX_HOSTS"); exists {
+		if intMaxHosts, error := strconv.Atoi(maxHosts); error != nil {
+			msg := "Wrong environment variable MAX_HOSTS"
+			fmt.Println(msg)
+			log.Fatalln(msg)
+
+		} else {
+			config.MaxHosts = intMaxHosts
+		}
+	}
+
+	if blacklistFile, exists := os.LookupEnv("BLACKLIST_FILE"); exists {
+		config.BlacklistFile = blacklistFile
+	}
+
+	if allowedOrigins, exists := os.LookupEnv("ALLOWED_ORIGINS"); exists {
+		config.AllowedOrigins = splitList(allowedOrigins)
+	}
+
+	if apiKeys, exists := os.LookupEnv("API_KEYS"); exists {
+		config.APIKeys = splitList(apiKeys)
+	}
+
+	if basicAuthUser, exists := os.LookupEnv("BASIC_AUTH_USER"); exists {
+		config.BasicAuthUser = basicAuthUser
+	}
+
+	if basicAuthPassword, exists := os.LookupEnv("BASIC_AUTH_PASSWORD"); exists {
+		config.BasicAuthPassword = basicAuthPassword
+	}
+}
+
+// LogFile is a log output that can be reopened after rotation
+type LogFile struct {
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+}
+
+func openLogFile(filename string) (*LogFile, error) {
+	l := &LogFile{filename: filename}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Write(b)
+}
+
+// Reopen swaps the file for a fresh one, keeping the old one if that fails
+func (l *LogFile) Reopen() error {
+	file, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file = file
+	l.mu.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// splitList parses a comma-separated environment variable
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Log levels, lines below LogLevel are dropped
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// logLevel is set from LogLevel, -v lowers it to debug
+var logLevel = levelInfo
+
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
 	}
+	return levelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+func logf(level int, format string, v ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	log.Printf(strings.ToUpper(logLevelNames[level])+" "+format, v...)
 }
 
 // MAIN
 
-func init() {
+// setup reads the flags and the config, it's not an init so tests don't
+func setup() {
 
 	// Reading flags
 	flag.BoolVar(&flagVersion, "V", false, "Print version information and quit")
@@ -806,34 +6435,275 @@ func init() {
 	readConfigFile(&flagConfigFilename)
 	readConfigEnv()
 
-	logVerbose(fmt.Sprintf("DBHost: %s", config.DBHost))
-	logVerbose(fmt.Sprintf("DBName: %s", config.DBName))
-	logVerbose(fmt.Sprintf("DBUser: %s", config.DBUser))
+	logLevel, _ = parseLogLevel(config.LogLevel)
+	if flagVerbose {
+		logLevel = levelDebug
+	}
+
+	logf(levelDebug, "DBHost: %s", config.DBHost)
+	logf(levelDebug, "DBName: %s", config.DBName)
+	logf(levelDebug, "DBUser: %s", config.DBUser)
 
 }
 
 func createServer(c Config) *Server {
-	flapper, err := createFlapper(c.SqlDSN())
-	if err != nil {
-		log.Fatalf("Unable to create server: %s", err)
+	flappers := map[string]*Flapper{}
+	for name := range c.Sources {
+		flapper, err := createFlapper(c.ForSource(name))
+		if err != nil {
+			log.Fatalf("Unable to create source %s: %s", name, err)
+		}
+		flapper.CheckTable(context.Background())
+		flappers[name] = flapper
+	}
+
+	flapper, ok := flappers[c.DefaultSource]
+	if !ok {
+		var err error
+		if flapper, err = createFlapper(c); err != nil {
+			log.Fatalf("Unable to create server: %s", err)
+		}
+		flapper.CheckTable(context.Background())
+	}
+
+	s := Server{
+		flapper:     flapper,
+		flappers:    flappers,
+		chartCache:  createChartCache(flapChartCacheSize),
+		reviewCache: createChartCache(reviewCacheSize),
+		streams:     createStreamLimiter(c.MaxStreams),
+		shutdown:    make(chan struct{}),
+		keepalives:  &sync.WaitGroup{},
+	}
+	if c.RateLimit > 0 {
+		s.limiter = createRateLimiter(c.RateLimit, c.RateBurst)
+	}
+	if c.MaxConcurrentQueries > 0 {
+		s.queries = createQueryLimiter(c.MaxConcurrentQueries, time.Duration(c.QueryQueueSec)*time.Second)
+	}
+
+	if c.DBKeepaliveSec > 0 {
+		all := []*Flapper{}
+		for _, f := range flappers {
+			all = append(all, f)
+		}
+		if !ok {
+			all = append(all, flapper)
+		}
+		for _, f := range all {
+			s.keepalives.Add(1)
+			go func(f *Flapper) {
+				defer s.keepalives.Done()
+				f.keepAlive(time.Duration(c.DBKeepaliveSec)*time.Second, s.shutdown)
+			}(f)
+		}
 	}
-	s := Server{flapper: flapper}
 	return &s
 }
 
+// listenUnix listens on a Unix socket, replacing the file a killed process left behind
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// reload is run on SIGHUP: logrotate moves the log file away and asks for a new one,
+// operators edit the blacklist. A broken blacklist keeps the previous one in use.
+func reload(logFile *LogFile) {
+	if logFile != nil {
+		if err := logFile.Reopen(); err != nil {
+			logf(levelError, "Unable to reopen log file: %s", err)
+		} else {
+			logf(levelInfo, "Log file reopened")
+		}
+	}
+
+	if config.BlacklistFile != "" {
+		if err := blacklist.Load(config.BlacklistFile); err != nil {
+			logf(levelError, "Unable to reload blacklist, keeping the previous one: %s", err)
+		} else {
+			logf(levelInfo, "Blacklist reloaded")
+		}
+	}
+}
+
+// redacted returns the config with passwords and API keys masked
+func (c Config) redacted() Config {
+	const mask = "REDACTED"
+	if c.DBPassword != "" {
+		c.DBPassword = mask
+	}
+	if c.BasicAuthPassword != "" {
+		c.BasicAuthPassword = mask
+	}
+	if len(c.APIKeys) > 0 {
+		c.APIKeys = []string{mask}
+	}
+	sources := make(map[string]SourceConfig, len(c.Sources))
+	for name, source := range c.Sources {
+		if source.DBPassword != "" {
+			source.DBPassword = mask
+		}
+		sources[name] = source
+	}
+	c.Sources = sources
+	return c
+}
+
+// dumpState is run on SIGUSR1: it logs the effective config and the connection pools
+func dumpState(s *Server) {
+	if dump, err := json.Marshal(config.redacted()); err != nil {
+		logf(levelError, "Unable to dump config: %s", err)
+	} else {
+		logf(levelInfo, "Config: %s", dump)
+	}
+
+	flappers := map[string]*Flapper{"": s.flapper}
+	for name, flapper := range s.flappers {
+		if flapper != s.flapper {
+			flappers[name] = flapper
+		}
+	}
+	names := make([]string, 0, len(flappers))
+	for name := range flappers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		stats := flappers[name].db.Stats()
+		if name == "" {
+			name = "default"
+		}
+		logf(levelInfo, "DB pool %s: open=%d in_use=%d idle=%d wait_count=%d wait_duration=%s "+
+			"max_idle_closed=%d max_idle_time_closed=%d max_lifetime_closed=%d",
+			name, stats.OpenConnections, stats.InUse, stats.Idle, stats.WaitCount, stats.WaitDuration,
+			stats.MaxIdleClosed, stats.MaxIdleTimeClosed, stats.MaxLifetimeClosed)
+	}
+}
+
 func main() {
 
+	setup()
+
+	if err := config.Validate(); err != nil {
+		msg := fmt.Sprintf("Invalid config:\n%s", err)
+		fmt.Println(msg)
+		log.Fatalln(msg)
+	}
+
+	trustedProxies, _ = parseCIDRs(config.TrustedProxies)
+
+	var logFile *LogFile
+	if config.LogFilename != "" {
+		var err error
+		logFile, err = openLogFile(config.LogFilename)
+		if err != nil {
+			msg := fmt.Sprintf("Unable to open log file: %s", err)
+			fmt.Println(msg)
+			log.Fatalln(msg)
+		}
+		if flagVerbose {
+			log.SetOutput(io.MultiWriter(os.Stdout, logFile))
+		} else {
+			log.SetOutput(logFile)
+		}
+	}
+
+	if config.BlacklistFile != "" {
+		if err := blacklist.Load(config.BlacklistFile); err != nil {
+			msg := fmt.Sprintf("Unable to load blacklist: %s", err)
+			fmt.Println(msg)
+			log.Fatalln(msg)
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload(logFile)
+		}
+	}()
+
+	useTLS := config.TLSCertFile != ""
+
 	s := createServer(config)
 
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			dumpState(s)
+		}
+	}()
+
 	fmt.Println("flapmyport_api version:", version, "build:", build)
-	msg := fmt.Sprintf("Listening on %s:%d", config.ListenAddress, config.ListenPort)
-	fmt.Println(msg)
 
-	http.HandleFunc("/", s.route)
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
 
-	listenSocket := fmt.Sprintf("%s:%d", config.ListenAddress, config.ListenPort)
-	err := http.ListenAndServe(listenSocket, nil)
+	var listener net.Listener
+	var err error
+	var msg string
+	if config.ListenSocket != "" {
+		listener, err = listenUnix(config.ListenSocket)
+		msg = fmt.Sprintf("Listening on %s over unix:%s", scheme, config.ListenSocket)
+	} else {
+		listenSocket := fmt.Sprintf("%s:%d", config.ListenAddress, config.ListenPort)
+		listener, err = net.Listen("tcp", listenSocket)
+		msg = fmt.Sprintf("Listening on %s://%s", scheme, listenSocket)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	fmt.Println(msg)
+	logf(levelInfo, "%s", msg)
+
+	http.HandleFunc("/", logRequests(s.route))
+	// A slow client must not hold a connection, nor a slow answer a writer, forever
+	server := &http.Server{
+		ReadHeaderTimeout: time.Duration(config.ReadTimeoutSec) * time.Second,
+		ReadTimeout:       time.Duration(config.ReadTimeoutSec) * time.Second,
+		WriteTimeout:      time.Duration(config.WriteTimeoutSec) * time.Second,
+		IdleTimeout:       time.Duration(config.IdleTimeoutSec) * time.Second,
+	}
+	// Shutdown waits for requests in flight, open streams end instead
+	server.RegisterOnShutdown(func() { close(s.shutdown) })
+
+	// Let requests in flight finish on SIGINT or SIGTERM.
+	// Closing the listener removes the Unix socket file.
+	stopped := make(chan struct{})
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		logf(levelInfo, "Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logf(levelError, "Shutdown: %s", err)
+		}
+		close(stopped)
+	}()
+
+	if useTLS {
+		err = server.ServeTLS(listener, config.TLSCertFile, config.TLSKeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	s.keepalives.Wait()
 }
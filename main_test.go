@@ -0,0 +1,807 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// testFlapper is a Flapper with the default config that never connects
+func testFlapper(t *testing.T) *Flapper {
+	t.Helper()
+	f, err := createFlapper(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// testServer serves f like createServer, without checking its table
+func testServer(f *Flapper) *Server {
+	return &Server{
+		flapper:     f,
+		flappers:    map[string]*Flapper{},
+		chartCache:  createChartCache(flapChartCacheSize),
+		reviewCache: createChartCache(reviewCacheSize),
+		streams:     createStreamLimiter(config.MaxStreams),
+		shutdown:    make(chan struct{}),
+		keepalives:  &sync.WaitGroup{},
+	}
+}
+
+// get routes a GET of the query string to s
+func get(s *Server, query string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	s.route(response, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+	return response
+}
+
+// feedRows makes f read rows instead of querying the database
+func feedRows(f *Flapper, rows []PortRow) {
+	f.fetchRows = func(ctx context.Context, query string, args ...interface{}) ([]PortRow, error) {
+		return rows, nil
+	}
+}
+
+func strp(s string) *string {
+	return &s
+}
+
+func testRow(t *testing.T, id int, at string, ip string, hostname *string, ifIndex int, status string) PortRow {
+	return PortRow{
+		Id:           id,
+		Time:         testTime(t, at),
+		Ipaddress:    ip,
+		Hostname:     hostname,
+		IfIndex:      ifIndex,
+		IfName:       strp(fmt.Sprintf("ge-0/0/%d", ifIndex)),
+		IfAlias:      strp(fmt.Sprintf("link %d", ifIndex)),
+		IfOperStatus: status,
+	}
+}
+
+func testTime(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.Parse(timeFormat, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+// dayWindow is the window of 2022-09-01 charted one hour per column
+func dayWindow(t *testing.T) QueryParams {
+	return QueryParams{
+		Start: testTime(t, "2022-09-01 00:00:00"),
+		End:   testTime(t, "2022-09-02 00:00:00"),
+		Width: 25,
+	}
+}
+
+func testFlap(t *testing.T, id int, at string, status string) Flap {
+	return Flap{Id: id, Time: JSONTime{testTime(t, at)}, IfOperStatus: status}
+}
+
+// columns expands runs of a state into the states of that many columns
+func columns(runs ...[2]int) []int {
+	states := []int{}
+	for _, run := range runs {
+		for i := 0; i < run[1]; i++ {
+			states = append(states, run[0])
+		}
+	}
+	return states
+}
+
+func TestTimelineStartsFromPriorFlap(t *testing.T) {
+	f := testFlapper(t)
+	prior := testFlap(t, 1, "2022-08-31 20:00:00", ifStatusUpCaption)
+	flaps := []Flap{
+		testFlap(t, 2, "2022-09-01 10:00:00", ifStatusDownCaption),
+		testFlap(t, 3, "2022-09-01 12:00:00", ifStatusUpCaption),
+	}
+	// The oldest row of the table doesn't matter with a prior flap
+	monitoredFrom := testTime(t, "2022-09-01 06:00:00")
+
+	states, cent := f.timelineStates(dayWindow(t), flaps, &prior, &monitoredFrom)
+	if cent != 3600 {
+		t.Fatalf("column spans %v seconds, want 3600", cent)
+	}
+	want := columns(
+		[2]int{chartStateSteadyUp, 10},
+		[2]int{chartStateDown, 1},
+		[2]int{chartStateSteadyDown, 1},
+		[2]int{chartStateUp, 1},
+		[2]int{chartStateSteadyUp, 12},
+	)
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+func TestTimelineFallsBackToOppositeOfFirstFlap(t *testing.T) {
+	f := testFlapper(t)
+
+	tests := []struct {
+		name          string
+		first         string
+		monitoredFrom string
+		want          []int
+	}{
+		{
+			name:          "monitored before the window",
+			first:         ifStatusDownCaption,
+			monitoredFrom: "2022-08-01 00:00:00",
+			want:          columns([2]int{chartStateSteadyUp, 10}, [2]int{chartStateDown, 1}, [2]int{chartStateSteadyDown, 14}),
+		},
+		{
+			name:          "monitored since within the window",
+			first:         ifStatusDownCaption,
+			monitoredFrom: "2022-09-01 06:00:00",
+			want:          columns([2]int{chartStateUnknown, 6}, [2]int{chartStateSteadyUp, 4}, [2]int{chartStateDown, 1}, [2]int{chartStateSteadyDown, 14}),
+		},
+		{
+			name:          "first flap up",
+			first:         ifStatusUpCaption,
+			monitoredFrom: "2022-08-01 00:00:00",
+			want:          columns([2]int{chartStateSteadyDown, 10}, [2]int{chartStateUp, 1}, [2]int{chartStateSteadyUp, 14}),
+		},
+		{
+			name:          "first flap is the oldest row",
+			first:         ifStatusDownCaption,
+			monitoredFrom: "2022-09-01 10:00:00",
+			want:          columns([2]int{chartStateUnknown, 10}, [2]int{chartStateDown, 1}, [2]int{chartStateSteadyDown, 14}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flaps := []Flap{testFlap(t, 1, "2022-09-01 10:00:00", tt.first)}
+			monitoredFrom := testTime(t, tt.monitoredFrom)
+
+			states, _ := f.timelineStates(dayWindow(t), flaps, nil, &monitoredFrom)
+			if !reflect.DeepEqual(states, tt.want) {
+				t.Errorf("states = %v, want %v", states, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimelineUnknownOnlyWithoutPriorFlap(t *testing.T) {
+	f := testFlapper(t)
+	flaps := []Flap{testFlap(t, 2, "2022-09-01 10:00:00", ifStatusDownCaption)}
+	after := columns([2]int{chartStateDown, 1}, [2]int{chartStateSteadyDown, 14})
+
+	// Steady up: the port was up before the window
+	prior := testFlap(t, 1, "2022-08-31 20:00:00", ifStatusUpCaption)
+	states, _ := f.timelineStates(dayWindow(t), flaps, &prior, nil)
+	want := append(columns([2]int{chartStateSteadyUp, 10}), after...)
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("steady up: states = %v, want %v", states, want)
+	}
+
+	// No data: no prior flap and nothing recorded before the first flap
+	for _, monitoredFrom := range []*time.Time{nil, &flaps[0].Time.Time} {
+		states, _ = f.timelineStates(dayWindow(t), flaps, nil, monitoredFrom)
+		want = append(columns([2]int{chartStateUnknown, 10}), after...)
+		if !reflect.DeepEqual(states, want) {
+			t.Errorf("no data since %v: states = %v, want %v", monitoredFrom, states, want)
+		}
+	}
+}
+
+// reviewPort and reviewHost are the parts of a review the tests compare
+type reviewPort struct {
+	IfIndex     int
+	IfName      string
+	IfAlias     string
+	FlapCount   int
+	First, Last string
+}
+
+type reviewHost struct {
+	Name, Ipaddress string
+	Ports           []reviewPort
+}
+
+func formatJSONTime(t *JSONTime) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(timeFormat)
+}
+
+func summarizeHosts(hosts []Host) []reviewHost {
+	summary := []reviewHost{}
+	for _, host := range hosts {
+		h := reviewHost{Name: host.Name, Ipaddress: host.Ipaddress}
+		for _, port := range host.Ports {
+			h.Ports = append(h.Ports, reviewPort{
+				IfIndex:   port.IfIndex,
+				IfName:    port.IfName,
+				IfAlias:   port.IfAlias,
+				FlapCount: port.FlapCount,
+				First:     formatJSONTime(port.FirstFlapTime),
+				Last:      formatJSONTime(port.LastFlapTime),
+			})
+		}
+		summary = append(summary, h)
+	}
+	return summary
+}
+
+func TestReview(t *testing.T) {
+	core1, core2 := strp("core1"), strp("core2")
+
+	tests := []struct {
+		name  string
+		rows  []PortRow
+		hosts []reviewHost
+		// totals of flaps, ports and hosts
+		flaps, ports, hostCount int
+		oldestID, newestID      int
+		first, last             string
+	}{
+		{
+			name: "hosts and ports",
+			rows: []PortRow{
+				testRow(t, 1, "2022-09-01 10:00:00", "10.0.0.1", core1, 1, ifStatusDownCaption),
+				testRow(t, 2, "2022-09-01 10:00:05", "10.0.0.1", core1, 1, ifStatusUpCaption),
+				testRow(t, 3, "2022-09-01 10:12:40", "10.0.0.1", core1, 2, ifStatusDownCaption),
+				testRow(t, 4, "2022-09-01 10:30:00", "10.0.0.2", core2, 7, ifStatusDownCaption),
+				testRow(t, 5, "2022-09-01 10:30:02", "10.0.0.2", core2, 7, ifStatusUpCaption),
+			},
+			hosts: []reviewHost{
+				{Name: "core1", Ipaddress: "10.0.0.1", Ports: []reviewPort{
+					{1, "ge-0/0/1", "link 1", 2, "2022-09-01 10:00:00", "2022-09-01 10:00:05"},
+					{2, "ge-0/0/2", "link 2", 1, "2022-09-01 10:12:40", "2022-09-01 10:12:40"},
+				}},
+				{Name: "core2", Ipaddress: "10.0.0.2", Ports: []reviewPort{
+					{7, "ge-0/0/7", "link 7", 2, "2022-09-01 10:30:00", "2022-09-01 10:30:02"},
+				}},
+			},
+			flaps: 5, ports: 3, hostCount: 2,
+			oldestID: 1, newestID: 5,
+			first: "2022-09-01 10:00:00", last: "2022-09-01 10:30:02",
+		},
+		{
+			name: "rows out of order",
+			rows: []PortRow{
+				testRow(t, 3, "2022-09-01 11:00:00", "10.0.0.1", core1, 1, ifStatusUpCaption),
+				testRow(t, 9, "2022-09-01 09:00:00", "10.0.0.1", core1, 1, ifStatusDownCaption),
+				testRow(t, 6, "2022-09-01 10:00:00", "10.0.0.1", core1, 1, ifStatusUpCaption),
+			},
+			hosts: []reviewHost{
+				{Name: "core1", Ipaddress: "10.0.0.1", Ports: []reviewPort{
+					{1, "ge-0/0/1", "link 1", 3, "2022-09-01 09:00:00", "2022-09-01 11:00:00"},
+				}},
+			},
+			flaps: 3, ports: 1, hostCount: 1,
+			oldestID: 3, newestID: 9,
+			first: "2022-09-01 09:00:00", last: "2022-09-01 11:00:00",
+		},
+		{
+			name: "null hostname, name and alias",
+			rows: []PortRow{
+				{Id: 1, Time: testTime(t, "2022-09-01 10:00:00"), Ipaddress: "10.0.0.3", IfIndex: 4, IfOperStatus: ifStatusDownCaption},
+			},
+			hosts: []reviewHost{
+				{Name: "", Ipaddress: "10.0.0.3", Ports: []reviewPort{
+					{4, "<ifIndex 4>", "", 1, "2022-09-01 10:00:00", "2022-09-01 10:00:00"},
+				}},
+			},
+			flaps: 1, ports: 1, hostCount: 1,
+			oldestID: 1, newestID: 1,
+			first: "2022-09-01 10:00:00", last: "2022-09-01 10:00:00",
+		},
+		{
+			name: "flaps at the window bounds",
+			rows: []PortRow{
+				testRow(t, 1, "2022-09-01 00:00:00", "10.0.0.1", core1, 1, ifStatusDownCaption),
+				testRow(t, 2, "2022-09-01 23:59:59", "10.0.0.1", core1, 1, ifStatusUpCaption),
+			},
+			hosts: []reviewHost{
+				{Name: "core1", Ipaddress: "10.0.0.1", Ports: []reviewPort{
+					{1, "ge-0/0/1", "link 1", 2, "2022-09-01 00:00:00", "2022-09-01 23:59:59"},
+				}},
+			},
+			flaps: 2, ports: 1, hostCount: 1,
+			oldestID: 1, newestID: 2,
+			first: "2022-09-01 00:00:00", last: "2022-09-01 23:59:59",
+		},
+		{
+			name:  "no rows",
+			hosts: []reviewHost{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := testFlapper(t)
+			feedRows(f, tt.rows)
+
+			result, err := f.Review(context.Background(), dayWindow(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if hosts := summarizeHosts(result.Hosts); !reflect.DeepEqual(hosts, tt.hosts) {
+				t.Errorf("hosts = %+v, want %+v", hosts, tt.hosts)
+			}
+			p := result.Params
+			if p.TotalFlaps != tt.flaps || p.TotalPorts != tt.ports || p.TotalHosts != tt.hostCount {
+				t.Errorf("totals = %d flaps, %d ports, %d hosts, want %d, %d, %d",
+					p.TotalFlaps, p.TotalPorts, p.TotalHosts, tt.flaps, tt.ports, tt.hostCount)
+			}
+			if p.OldestFlapID != tt.oldestID || p.NewestFlapID != tt.newestID {
+				t.Errorf("flap ids = %d..%d, want %d..%d", p.OldestFlapID, p.NewestFlapID, tt.oldestID, tt.newestID)
+			}
+			if first := formatJSONTime(p.FirstFlapTime); first != tt.first {
+				t.Errorf("firstFlapTime = %q, want %q", first, tt.first)
+			}
+			if last := formatJSONTime(p.LastFlapTime); last != tt.last {
+				t.Errorf("lastFlapTime = %q, want %q", last, tt.last)
+			}
+			// The coverage of the window is that of its rows
+			if start := formatJSONTime(p.CoverageStart); start != tt.first {
+				t.Errorf("coverageStart = %q, want %q", start, tt.first)
+			}
+			if end := formatJSONTime(p.CoverageEnd); end != tt.last {
+				t.Errorf("coverageEnd = %q, want %q", end, tt.last)
+			}
+		})
+	}
+}
+
+func TestTimelineSkipsUnknownStatus(t *testing.T) {
+	f := testFlapper(t)
+	prior := testFlap(t, 1, "2022-08-31 20:00:00", ifStatusUpCaption)
+	flaps := []Flap{testFlap(t, 2, "2022-09-01 10:00:00", ifStatusUnknownCaption)}
+
+	states, _ := f.timelineStates(dayWindow(t), flaps, &prior, nil)
+	want := columns([2]int{chartStateSteadyUp, 25})
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+func TestFlapChartEmptyWindow(t *testing.T) {
+	f := testFlapper(t)
+	f.fetchRows = func(ctx context.Context, query string, args ...interface{}) ([]PortRow, error) {
+		t.Error("an empty window was queried")
+		return nil, nil
+	}
+
+	q := dayWindow(t)
+	q.End = q.Start
+	if _, err := f.Timeline(context.Background(), q); !errors.Is(err, errEmptyWindow) {
+		t.Errorf("Timeline of an empty window: err = %v, want %v", err, errEmptyWindow)
+	}
+
+	s := testServer(f)
+	for _, window := range []string{
+		"start=2022-09-01%2010:00:00&end=2022-09-01%2010:00:00",
+		"start=2022-09-01%2010:00:00&end=2022-09-01%2009:00:00",
+	} {
+		for _, format := range []string{"", "&format=json"} {
+			response := get(s, "flapchart&host=10.0.0.1&ifindex=1&"+window+format)
+			if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), errEmptyWindow.Error()) {
+				t.Errorf("%s%s: %d %s, want %d %s", window, format, response.Code, response.Body, http.StatusBadRequest, errEmptyWindow)
+			}
+		}
+	}
+}
+
+func TestTimelineOrdersSameSecondByTimeTicks(t *testing.T) {
+	f := testFlapper(t)
+	prior := testFlap(t, 1, "2022-08-31 20:00:00", ifStatusUpCaption)
+
+	tests := []struct {
+		name       string
+		down, up   int64 // timeticks of the flaps
+		last, fill int
+	}{
+		{"down then up", 100, 200, chartStateFlappingUp, chartStateSteadyUp},
+		{"up then down", 200, 100, chartStateFlappingDown, chartStateSteadyDown},
+	}
+
+	for _, tt := range tests {
+		down := testFlap(t, 2, "2022-09-01 10:00:00", ifStatusDownCaption)
+		down.TimeTicks = tt.down
+		up := testFlap(t, 3, "2022-09-01 10:00:00", ifStatusUpCaption)
+		up.TimeTicks = tt.up
+		want := columns([2]int{chartStateSteadyUp, 10}, [2]int{tt.last, 1}, [2]int{tt.fill, 14})
+
+		// The order the database returns them in doesn't matter
+		for _, flaps := range [][]Flap{{down, up}, {up, down}} {
+			states, _ := f.timelineStates(dayWindow(t), flaps, &prior, nil)
+			if !reflect.DeepEqual(states, want) {
+				t.Errorf("%s, flaps %d then %d: states = %v, want %v", tt.name, flaps[0].Id, flaps[1].Id, states, want)
+			}
+		}
+	}
+}
+
+func TestTiedSortKeysOrderStably(t *testing.T) {
+	f := testFlapper(t)
+	q := dayWindow(t)
+	q.Host = "10.0.0.1"
+
+	// Ports 3, 5 and 9 flapped once, port 7 twice
+	var rows []PortRow
+	for i, ifIndex := range []int{5, 7, 3, 9, 7} {
+		rows = append(rows, testRow(t, i+1, fmt.Sprintf("2022-09-01 10:00:%02d", i), "10.0.0.1", nil, ifIndex, ifStatusDownCaption))
+	}
+	wantPorts := []int{7, 3, 5, 9}
+
+	// Hosts 10.0.0.1-3 flapped twice, 10.0.0.4 five times
+	hosts := []Host{
+		{Ipaddress: "10.0.0.3", Ports: []PortView{{FlapCount: 2}}},
+		{Ipaddress: "10.0.0.1", Ports: []PortView{{FlapCount: 2}}},
+		{Ipaddress: "10.0.0.4", Ports: []PortView{{FlapCount: 5}}},
+		{Ipaddress: "10.0.0.2", Ports: []PortView{{FlapCount: 1}, {FlapCount: 1}}},
+	}
+	wantHosts := map[string]bool{"10.0.0.1": true, "10.0.0.4": true}
+
+	random := rand.New(rand.NewSource(1))
+	for run := 0; run < 20; run++ {
+		random.Shuffle(len(rows), func(i, j int) { rows[i], rows[j] = rows[j], rows[i] })
+		feedRows(f, rows)
+		ports, err := f.HostPorts(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ifIndexes := []int{}
+		for _, port := range ports {
+			ifIndexes = append(ifIndexes, port.IfIndex)
+		}
+		if !reflect.DeepEqual(ifIndexes, wantPorts) {
+			t.Errorf("run %d: ports %v, want %v", run, ifIndexes, wantPorts)
+		}
+
+		random.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+		result := ReviewResult{Hosts: append([]Host{}, hosts...)}
+		result.limitHosts(2)
+		kept := map[string]bool{}
+		for _, host := range result.Hosts {
+			kept[host.Ipaddress] = true
+		}
+		if !reflect.DeepEqual(kept, wantHosts) {
+			t.Errorf("run %d: kept hosts %v, want %v", run, kept, wantHosts)
+		}
+	}
+}
+
+func TestTimelineAcrossDSTChange(t *testing.T) {
+	f := testFlapper(t)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := func(s string) time.Time {
+		tm, err := time.ParseInLocation(timeFormat, s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	// The clocks go back from 03:00 to 02:00 on 2022-10-30, the day has 25 hours
+	start, end := local("2022-10-30 00:00:00"), local("2022-10-31 00:00:00")
+	prior := Flap{Id: 1, Time: JSONTime{local("2022-10-29 12:00:00")}, IfOperStatus: ifStatusUpCaption}
+	flaps := []Flap{
+		// 02:30 is ambiguous on the clock, once in CEST and once in CET
+		{Id: 2, Time: JSONTime{testTime(t, "2022-10-30 00:30:00").In(berlin)}, IfOperStatus: ifStatusDownCaption},
+		{Id: 3, Time: JSONTime{testTime(t, "2022-10-30 01:30:00").In(berlin)}, IfOperStatus: ifStatusUpCaption},
+		{Id: 4, Time: JSONTime{local("2022-10-30 12:00:00")}, IfOperStatus: ifStatusDownCaption},
+	}
+	// One column per hour on the clock, the repeated hour included
+	want := columns(
+		[2]int{chartStateSteadyUp, 2},
+		[2]int{chartStateDown, 1},
+		[2]int{chartStateUp, 1},
+		[2]int{chartStateSteadyUp, 9},
+		[2]int{chartStateDown, 1},
+		[2]int{chartStateSteadyDown, 12},
+	)
+
+	for _, zone := range []*time.Location{time.UTC, berlin} {
+		q := QueryParams{Start: start.In(zone), End: end.In(zone), Width: 26}
+		states, cent := f.timelineStates(q, flaps, &prior, nil)
+		if cent != 3600 {
+			t.Errorf("%s: column spans %v seconds, want 3600", zone, cent)
+		}
+		if !reflect.DeepEqual(states, want) {
+			t.Errorf("%s: states = %v, want %v", zone, states, want)
+		}
+	}
+}
+
+func TestTimelineDominantColumns(t *testing.T) {
+	f := testFlapper(t)
+	prior := testFlap(t, 1, "2022-08-31 20:00:00", ifStatusDownCaption)
+
+	// A port down all day comes up for a moment at the end of a column
+	blip := []Flap{
+		testFlap(t, 2, "2022-09-01 10:05:00", ifStatusDownCaption),
+		testFlap(t, 3, "2022-09-01 10:10:00", ifStatusDownCaption),
+		testFlap(t, 4, "2022-09-01 10:50:00", ifStatusUpCaption),
+	}
+	// As many ups as downs, the last flap decides
+	tie := []Flap{
+		testFlap(t, 2, "2022-09-01 10:05:00", ifStatusDownCaption),
+		testFlap(t, 3, "2022-09-01 10:10:00", ifStatusUpCaption),
+		testFlap(t, 4, "2022-09-01 10:50:00", ifStatusDownCaption),
+		testFlap(t, 5, "2022-09-01 10:55:00", ifStatusUpCaption),
+	}
+
+	tests := []struct {
+		name       string
+		dominant   bool
+		flaps      []Flap
+		last, fill int
+	}{
+		{"last flap of a blip", false, blip, chartStateFlappingUp, chartStateSteadyUp},
+		{"dominant down around a blip", true, blip, chartStateFlappingDown, chartStateSteadyDown},
+		{"last flap of a tie", true, tie, chartStateFlappingUp, chartStateSteadyUp},
+	}
+
+	for _, tt := range tests {
+		f.dominantColumns = tt.dominant
+		states, _ := f.timelineStates(dayWindow(t), tt.flaps, &prior, nil)
+		want := columns([2]int{chartStateSteadyDown, 10}, [2]int{tt.last, 1}, [2]int{tt.fill, 14})
+		if !reflect.DeepEqual(states, want) {
+			t.Errorf("%s: states = %v, want %v", tt.name, states, want)
+		}
+	}
+}
+
+func TestFlapChartRejectsAbsurdSize(t *testing.T) {
+	f := testFlapper(t)
+	f.fetchRows = func(ctx context.Context, query string, args ...interface{}) ([]PortRow, error) {
+		t.Error("a chart of an absurd size was queried")
+		return nil, nil
+	}
+	s := testServer(f)
+
+	tests := []struct {
+		size, want string
+	}{
+		{"width=100000000", fmt.Sprintf("width exceeds the limit of %d", config.MaxChartWidth)},
+		{"height=100000000", fmt.Sprintf("height exceeds the limit of %d", config.MaxChartHeight)},
+		{"width=1", "invalid width"},
+		{"height=-5", "invalid height"},
+	}
+
+	for _, tt := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		response := get(s, "flapchart&host=10.0.0.1&ifindex=1&"+tt.size)
+		runtime.ReadMemStats(&after)
+
+		if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), tt.want) {
+			t.Errorf("%s: %d %s, want %d %s", tt.size, response.Code, response.Body, http.StatusBadRequest, tt.want)
+		}
+		// A chart of that width alone would take gigabytes
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: %d bytes allocated", tt.size, allocated)
+		}
+	}
+}
+
+func TestLogsMaskAPIKey(t *testing.T) {
+	apiKeys := config.APIKeys
+	config.APIKeys = []string{"valid-key"}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() {
+		config.APIKeys = apiKeys
+		log.SetOutput(os.Stderr)
+	})
+
+	s := testServer(testFlapper(t))
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/?review&key=leaked-key&filter=core", nil)
+	logRequests(s.route)(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusUnauthorized)
+	}
+	lines := logged.String()
+	if strings.Contains(lines, "leaked-key") {
+		t.Errorf("the key is logged:\n%s", lines)
+	}
+	if !strings.Contains(lines, "invalid or missing credentials") || !strings.Contains(lines, "/?review&key=REDACTED&filter=core 401") {
+		t.Errorf("the failed request isn't logged:\n%s", lines)
+	}
+}
+
+func TestPostgresFilterIgnoresCase(t *testing.T) {
+	filter := Filter{}
+	v := url.Values{getParamFilter: {`core !lab host:=Core1`}}
+	if err := filter.ParseFilter(v, config.Columns, postgresDialect{}); err != nil {
+		t.Fatal(err)
+	}
+
+	conditions := strings.Join(filter.Conditions, " ")
+	for _, want := range []string{
+		"hostname ILIKE ?",
+		"NOT (hostname ILIKE ?)",
+		"LOWER(hostname) = LOWER(?)",
+	} {
+		if !strings.Contains(conditions, want) {
+			t.Errorf("conditions %q lack %q", conditions, want)
+		}
+	}
+	if strings.Contains(conditions, " LIKE ") {
+		t.Errorf("conditions %q have a case-sensitive LIKE", conditions)
+	}
+}
+
+func TestPostgresSSLMode(t *testing.T) {
+	c := config
+	c.DBDriver = driverPostgres
+	c.DBHost = "db.example.com:5432"
+
+	tests := []struct {
+		sslMode, want string
+	}{
+		{"", "postgres://root:@db.example.com:5432/snmpflapd"},
+		{"verify-full", "postgres://root:@db.example.com:5432/snmpflapd?sslmode=verify-full"},
+	}
+	for _, tt := range tests {
+		c.DBSSLMode = tt.sslMode
+		if dsn := c.SqlDSN(); dsn != tt.want {
+			t.Errorf("DBSSLMode %q: DSN %s, want %s", tt.sslMode, dsn, tt.want)
+		}
+	}
+
+	c.DBSSLMode = "prefer"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "DBSSLMode") {
+		t.Errorf("DBSSLMode prefer: err = %v, want it rejected", err)
+	}
+}
+
+func TestClientIPTrustsOnlyProxies(t *testing.T) {
+	trustProxy, proxies := config.TrustProxy, trustedProxies
+	trustedProxies, _ = parseCIDRs([]string{"10.0.0.0/24"})
+	t.Cleanup(func() {
+		config.TrustProxy, trustedProxies = trustProxy, proxies
+	})
+
+	tests := []struct {
+		trustProxy      bool
+		peer, forwarded string
+		want            string
+	}{
+		{false, "192.0.2.7:4000", "198.51.100.1", "192.0.2.7"},
+		{true, "192.0.2.7:4000", "198.51.100.1", "192.0.2.7"},
+		{false, "10.0.0.10:4000", "198.51.100.1, 10.0.0.20", "198.51.100.1"},
+		{true, "10.0.0.10:4000", "198.51.100.1, 10.0.0.20", "10.0.0.20"},
+	}
+	for _, tt := range tests {
+		config.TrustProxy = tt.trustProxy
+		request := httptest.NewRequest(http.MethodGet, "/?review", nil)
+		request.RemoteAddr = tt.peer
+		request.Header.Set("X-Forwarded-For", tt.forwarded)
+		if ip := clientIP(request); ip != tt.want {
+			t.Errorf("TrustProxy %v, peer %s, X-Forwarded-For %q: client %s, want %s", tt.trustProxy, tt.peer, tt.forwarded, ip, tt.want)
+		}
+	}
+
+	c := config
+	c.TrustProxy, c.TrustedProxies = true, nil
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "TrustProxy") {
+		t.Errorf("TrustProxy without TrustedProxies: err = %v, want it rejected", err)
+	}
+}
+
+func TestLogFileIsOptIn(t *testing.T) {
+	c := config
+	if c.LogFilename != "" {
+		t.Errorf("LogFilename defaults to %q, want stderr", c.LogFilename)
+	}
+
+	c.LogFilename = t.TempDir() + "/flapmyport_api.log"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(c.LogFilename); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Validate created %s: %v", c.LogFilename, err)
+	}
+}
+
+// fakeStore serves canned flaps instead of a database
+type fakeStore struct {
+	flaps []Flap
+}
+
+func (s fakeStore) Review(ctx context.Context, q QueryParams) (ReviewResult, error) {
+	return ReviewResult{}, nil
+}
+
+func (s fakeStore) PortFlaps(ctx context.Context, q QueryParams, afterID int, limit int) ([]Flap, error) {
+	var flaps []Flap
+	for _, flap := range s.flaps {
+		if flap.Id > afterID && len(flaps) < limit {
+			flaps = append(flaps, flap)
+		}
+	}
+	return flaps, nil
+}
+
+// windowStore records the window of the last review
+type windowStore struct {
+	fakeStore
+	start, end time.Time
+}
+
+func (s *windowStore) Review(ctx context.Context, q QueryParams) (ReviewResult, error) {
+	s.start, s.end = q.Start, q.End
+	return ReviewResult{}, nil
+}
+
+func TestReviewCacheKeepsAskedWindow(t *testing.T) {
+	ttl := config.ReviewCacheTTLSec
+	config.ReviewCacheTTLSec = 3600
+	t.Cleanup(func() { config.ReviewCacheTTLSec = ttl })
+
+	f := testFlapper(t)
+	store := &windowStore{}
+	f.store = store
+	s := testServer(f)
+
+	end := time.Now().UTC().Truncate(time.Second)
+	if end.Equal(end.Truncate(time.Hour)) {
+		end = end.Add(-time.Second)
+	}
+	start := end.Add(-time.Hour)
+	response := get(s, "review&start="+url.QueryEscape(start.Format(timeFormat))+"&end="+url.QueryEscape(end.Format(timeFormat)))
+	if response.Code != http.StatusOK {
+		t.Fatalf("%d %s", response.Code, response.Body)
+	}
+	if !store.start.Equal(start) || !store.end.Equal(end) {
+		t.Errorf("reviewed %s - %s, want %s - %s", store.start, store.end, start, end)
+	}
+}
+
+func TestFlapHistoryFromStore(t *testing.T) {
+	f := testFlapper(t)
+	f.store = fakeStore{flaps: []Flap{
+		testFlap(t, 1, "2022-09-01 10:00:00", ifStatusDownCaption),
+		testFlap(t, 2, "2022-09-01 10:00:05", ifStatusUpCaption),
+		testFlap(t, 3, "2022-09-01 11:00:00", ifStatusDownCaption),
+	}}
+	s := testServer(f)
+
+	response := get(s, "flaphistory&host=10.0.0.1&ifindex=1&limit=2&afterId=0")
+	if response.Code != http.StatusOK {
+		t.Fatalf("%d %s", response.Code, response.Body)
+	}
+	var history struct {
+		Flaps   []struct{ Id int }
+		HasMore bool
+		LastID  int
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Flaps) != 2 || !history.HasMore || history.LastID != 2 {
+		t.Errorf("flaphistory = %s, want flaps 1 and 2 of more", response.Body)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Vladislav Pavkin
+
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLITE
+//
+// A self-contained Store for demos and tests, a Flapper on this dialect.
+// Times are stored in UTC as "2006-01-02 15:04:05" strings, so no time zone
+// conversion is needed.
+
+func init() {
+	dialects[driverSQLite] = sqliteDialect{}
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Driver() string {
+	return "sqlite3"
+}
+
+func (sqliteDialect) UTC(column string) string {
+	return column
+}
+
+func (sqliteDialect) Rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) TruncTime(expr string, bucket string) string {
+	if bucket == statsBucketDay {
+		return fmt.Sprintf("strftime('%%Y-%%m-%%d 00:00:00', %s)", expr)
+	}
+	return fmt.Sprintf("strftime('%%Y-%%m-%%d %%H:00:00', %s)", expr)
+}
+
+// LIKE has no escape character unless it's given, and ignores the case of ASCII letters only
+func (sqliteDialect) Like(column string) string {
+	return column + ` LIKE ? ESCAPE '\'`
+}
+
+func (sqliteDialect) Equal(column string) string {
+	return column + " = ? COLLATE NOCASE"
+}
+
+// Setup creates the ports table and seeds it with DBFixture
+func (sqliteDialect) Setup(db *sql.DB, c Config) error {
+	// SQLite serializes writers anyway, and a single connection keeps an in-memory database alive
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+
+	cols := c.Columns
+	schema := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		%s INTEGER PRIMARY KEY AUTOINCREMENT,
+		%s TEXT NOT NULL DEFAULT '',
+		%s DATETIME NOT NULL,
+		%s INTEGER NOT NULL DEFAULT 0,
+		%s TEXT NOT NULL,
+		%s TEXT,
+		%s INTEGER NOT NULL,
+		%s TEXT,
+		%s TEXT,
+		%s TEXT,
+		%s INTEGER,
+		%s TEXT
+	);`, c.DBTable, cols.Id, cols.Sid, cols.Time, cols.TimeTicks, cols.Ipaddress,
+		cols.Hostname, cols.IfIndex, cols.IfName, cols.IfAlias, cols.IfOperStatus,
+		cols.IfSpeed, cols.IfAdminStatus)
+
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("unable to create %s: %s", c.DBTable, err)
+	}
+
+	if c.DBFixture == "" {
+		return nil
+	}
+	return loadFixture(db, c.DBTable, cols, c.DBFixture)
+}
+
+// fixtureRow is a ports row in a DBFixture file
+type fixtureRow struct {
+	Sid           string  `json:"sid"`
+	Time          string  `json:"time"`
+	TimeTicks     int64   `json:"timeticks"`
+	Ipaddress     string  `json:"ipaddress"`
+	Hostname      *string `json:"hostname"`
+	IfIndex       int     `json:"ifIndex"`
+	IfName        *string `json:"ifName"`
+	IfAlias       *string `json:"ifAlias"`
+	IfOperStatus  *string `json:"ifOperStatus"`
+	IfSpeed       *int64  `json:"ifSpeed"`
+	IfAdminStatus *string `json:"ifAdminStatus"`
+}
+
+func loadFixture(db *sql.DB, table string, cols ColumnsConfig, filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read fixture: %s", err)
+	}
+
+	var rows []fixtureRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return fmt.Errorf("invalid fixture %s: %s", filename, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert := fmt.Sprintf(`INSERT INTO %s (%s, %s, %s, %s, %s,
+		%s, %s, %s, %s, %s, %s)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`, table, cols.Sid, cols.Time, cols.TimeTicks,
+		cols.Ipaddress, cols.Hostname, cols.IfIndex, cols.IfName, cols.IfAlias, cols.IfOperStatus,
+		cols.IfSpeed, cols.IfAdminStatus)
+
+	for i, row := range rows {
+		if _, err := time.Parse(timeFormat, row.Time); err != nil {
+			return fmt.Errorf("fixture row %d: invalid time: %s", i, err)
+		}
+
+		_, err := tx.Exec(insert,
+			row.Sid,
+			row.Time,
+			row.TimeTicks,
+			row.Ipaddress,
+			row.Hostname,
+			row.IfIndex,
+			row.IfName,
+			row.IfAlias,
+			row.IfOperStatus,
+			row.IfSpeed,
+			row.IfAdminStatus,
+		)
+		if err != nil {
+			return fmt.Errorf("fixture row %d: %s", i, err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,312 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// sqliteFlapper is a Flapper on an in-memory database seeded with fixture, if any
+func sqliteFlapper(t *testing.T, fixture string) *Flapper {
+	t.Helper()
+	c := config
+	c.DBDriver = driverSQLite
+	c.DBName = ":memory:"
+	c.DBFixture = fixture
+
+	f, err := createFlapper(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.db.Close() })
+	return f
+}
+
+func TestFetchNullStatus(t *testing.T) {
+	f := sqliteFlapper(t, "")
+	c := f.columns
+	insert := fmt.Sprintf(`INSERT INTO %s (%s, %s, %s, %s)
+		VALUES ('2022-09-01 10:00:00', '10.0.0.1', 1, NULL);`, f.table, c.Time, c.Ipaddress, c.IfIndex, c.IfOperStatus)
+	if _, err := f.db.Exec(insert); err != nil {
+		t.Fatal(err)
+	}
+
+	q := dayWindow(t)
+	q.Host, q.IfIndex = "10.0.0.1", 1
+	flaps, err := f.PortFlaps(context.Background(), q, 0, defaultFlapHistoryLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flaps) != 1 || flaps[0].IfOperStatus != ifStatusUnknownCaption {
+		t.Fatalf("flaps = %+v, want one with status %s", flaps, ifStatusUnknownCaption)
+	}
+	if flaps[0].IsUp() || flaps[0].IsDown() {
+		t.Errorf("a flap of unknown status is up or down")
+	}
+}
+
+func TestFixtureEndToEnd(t *testing.T) {
+	s := testServer(sqliteFlapper(t, "example_fixture.json"))
+	const window = "start=2022-09-01%2000:00:00&end=2022-09-02%2000:00:00"
+
+	response := get(s, "review&"+window)
+	if response.Code != http.StatusOK {
+		t.Fatalf("review: %d %s", response.Code, response.Body)
+	}
+	var review struct {
+		Params struct {
+			TotalFlaps, TotalPorts, TotalHosts int
+			CoverageStart, CoverageEnd         string
+		}
+		Hosts []struct {
+			Name  string
+			Ports []struct{ IfIndex, FlapCount int }
+		}
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	p := review.Params
+	if p.TotalFlaps != 5 || p.TotalPorts != 3 || p.TotalHosts != 2 {
+		t.Errorf("review totals = %d flaps, %d ports, %d hosts, want 5, 3, 2", p.TotalFlaps, p.TotalPorts, p.TotalHosts)
+	}
+	if p.CoverageStart != "2022-09-01T10:00:00Z" || p.CoverageEnd != "2022-09-01T10:30:02Z" {
+		t.Errorf("review coverage = %s..%s", p.CoverageStart, p.CoverageEnd)
+	}
+	ports := map[string][]int{}
+	for _, host := range review.Hosts {
+		for _, port := range host.Ports {
+			ports[host.Name] = append(ports[host.Name], port.IfIndex, port.FlapCount)
+		}
+	}
+	if want := map[string][]int{"core1": {1, 2, 2, 1}, "core2": {7, 2}}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("review ports and flaps = %v, want %v", ports, want)
+	}
+
+	response = get(s, "flaphistory&host=10.0.0.1&ifindex=1&"+window)
+	if response.Code != http.StatusOK {
+		t.Fatalf("flaphistory: %d %s", response.Code, response.Body)
+	}
+	var history struct {
+		Flaps []struct {
+			Id           int
+			IfOperStatus string
+			DurationSec  *int64
+		}
+		HasMore bool
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Flaps) != 2 || history.HasMore ||
+		history.Flaps[0].Id != 1 || history.Flaps[0].IfOperStatus != ifStatusDownCaption ||
+		history.Flaps[0].DurationSec == nil || *history.Flaps[0].DurationSec != 5 ||
+		history.Flaps[1].Id != 2 || history.Flaps[1].IfOperStatus != ifStatusUpCaption {
+		t.Errorf("flaphistory = %s", response.Body)
+	}
+
+	response = get(s, "flapchart&host=10.0.0.1&ifindex=1&"+window)
+	if response.Code != http.StatusOK {
+		t.Fatalf("flapchart: %d %s", response.Code, response.Body)
+	}
+	chart, err := png.Decode(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := chart.Bounds().Size(); size.X != flapChartWidth || size.Y != flapChartHeight {
+		t.Errorf("flapchart is %v, want %dx%d", size, flapChartWidth, flapChartHeight)
+	}
+
+	// core2 was monitored since the first row of core1, before its own first flap
+	response = get(s, "flapchart&host=10.0.0.2&ifindex=7&format=json&"+window)
+	if response.Code != http.StatusOK {
+		t.Fatalf("flapchart json: %d %s", response.Code, response.Body)
+	}
+	var timeline FlapTimeline
+	if err := json.Unmarshal(response.Body.Bytes(), &timeline); err != nil {
+		t.Fatal(err)
+	}
+	monitored := int(10 * 3600 / timeline.BucketSeconds)
+	flapped := int((10*3600 + 30*60) / timeline.BucketSeconds)
+	if len(timeline.States) != flapChartWidth ||
+		timeline.States[monitored-1] != chartStateUnknown ||
+		timeline.States[monitored] != chartStateSteadyUp ||
+		timeline.States[flapped] != chartStateFlappingUp {
+		t.Errorf("flapchart states = %v", timeline.States)
+	}
+}
+
+func TestFilterWildcardsMatchLiterally(t *testing.T) {
+	f := sqliteFlapper(t, "")
+	c := f.columns
+	insert := fmt.Sprintf(`INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s)
+		VALUES ('2022-09-01 10:00:00', '10.0.0.1', 'Core1', ?, 'ge-0/0/0', ?, 'down');`,
+		f.table, c.Time, c.Ipaddress, c.Hostname, c.IfIndex, c.IfName, c.IfAlias, c.IfOperStatus)
+	aliases := []string{"load 50%", "load 500", "a_b", "axb", `back\slash`, "backslash"}
+	for i, alias := range aliases {
+		if _, err := f.db.Exec(insert, i+1, alias); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := testServer(f)
+
+	tests := []struct {
+		filter    string
+		ifIndexes []int
+	}{
+		{"50%", []int{1}},
+		{"a_b", []int{3}},
+		{`back\slash`, []int{5}},
+		{"!50%", []int{2, 3, 4, 5, 6}},
+		{"host:=CORE1 axb", []int{4}},
+	}
+	for _, tt := range tests {
+		response := get(s, "review&start=2022-09-01%2000:00:00&end=2022-09-02%2000:00:00&filter="+url.QueryEscape(tt.filter))
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.filter, response.Code, response.Body)
+		}
+		var review struct {
+			Hosts []struct {
+				Ports []struct{ IfIndex int }
+			}
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &review); err != nil {
+			t.Fatal(err)
+		}
+		ifIndexes := []int{}
+		for _, host := range review.Hosts {
+			for _, port := range host.Ports {
+				ifIndexes = append(ifIndexes, port.IfIndex)
+			}
+		}
+		if !reflect.DeepEqual(ifIndexes, tt.ifIndexes) {
+			t.Errorf("filter %s matched ports %v, want %v", tt.filter, ifIndexes, tt.ifIndexes)
+		}
+	}
+}
+
+func TestHostListMatchesStoredSpellings(t *testing.T) {
+	f := sqliteFlapper(t, "")
+	c := f.columns
+	insert := fmt.Sprintf(`INSERT INTO %s (%s, %s, %s, %s, %s, %s)
+		VALUES ('2022-09-01 10:00:00', ?, 'edge', 1, 'ge-0/0/0', 'down');`,
+		f.table, c.Time, c.Ipaddress, c.Hostname, c.IfIndex, c.IfName, c.IfOperStatus)
+	for _, ip := range []string{"2001:0db8:0:0::1", "10.0.0.1", "10.0.0.2"} {
+		if _, err := f.db.Exec(insert, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := testServer(f)
+
+	tests := []struct {
+		hosts string
+		want  []string
+	}{
+		{"2001:db8::1", []string{"2001:db8::1"}},
+		{"2001:db8::1,10.0.0.1", []string{"10.0.0.1", "2001:db8::1"}},
+	}
+	for _, tt := range tests {
+		response := get(s, "review&start=2022-09-01%2000:00:00&end=2022-09-02%2000:00:00&host="+url.QueryEscape(tt.hosts))
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", tt.hosts, response.Code, response.Body)
+		}
+		var review struct {
+			Hosts []struct{ Ipaddress string }
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &review); err != nil {
+			t.Fatal(err)
+		}
+		addresses := []string{}
+		for _, host := range review.Hosts {
+			addresses = append(addresses, host.Ipaddress)
+		}
+		if !reflect.DeepEqual(addresses, tt.want) {
+			t.Errorf("host=%s reviewed %v, want %v", tt.hosts, addresses, tt.want)
+		}
+	}
+}
+
+// countingStore counts the reviews asked from a Store
+type countingStore struct {
+	Store
+	reviews int
+}
+
+func (c *countingStore) Review(ctx context.Context, q QueryParams) (ReviewResult, error) {
+	c.reviews++
+	return c.Store.Review(ctx, q)
+}
+
+func TestHostFlapChartNotModifiedSkipsPorts(t *testing.T) {
+	f := sqliteFlapper(t, "example_fixture.json")
+	store := &countingStore{Store: f.store}
+	f.store = store
+	s := testServer(f)
+	const query = "/?flapchart&host=10.0.0.1&start=2022-09-01%2000:00:00&end=2022-09-02%2000:00:00"
+
+	response := httptest.NewRecorder()
+	s.route(response, httptest.NewRequest(http.MethodGet, query, nil))
+	etag := response.Header().Get("ETag")
+	if response.Code != http.StatusOK || etag == "" || store.reviews != 1 {
+		t.Fatalf("flapchart: %d, ETag %q, %d reviews", response.Code, etag, store.reviews)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, query, nil)
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+	s.route(response, request)
+	if response.Code != http.StatusNotModified {
+		t.Errorf("flapchart If-None-Match: %d, want %d", response.Code, http.StatusNotModified)
+	}
+
+	response = httptest.NewRecorder()
+	s.route(response, httptest.NewRequest(http.MethodGet, query, nil))
+	if response.Code != http.StatusOK || response.Header().Get("ETag") != etag {
+		t.Errorf("cached flapchart: %d, ETag %q, want %q", response.Code, response.Header().Get("ETag"), etag)
+	}
+	if store.reviews != 1 {
+		t.Errorf("ports of the host looked up %d times, want once", store.reviews)
+	}
+}
+
+func TestExcludeIfNamesSparesNamedPort(t *testing.T) {
+	f := sqliteFlapper(t, "")
+	c := f.columns
+	insert := fmt.Sprintf(`INSERT INTO %s (%s, %s, %s, %s, %s, %s)
+		VALUES ('2022-09-01 10:00:00', '10.0.0.1', 'core1', 5, 'ge-0/0/0.100', 'down');`,
+		f.table, c.Time, c.Ipaddress, c.Hostname, c.IfIndex, c.IfName, c.IfOperStatus)
+	if _, err := f.db.Exec(insert); err != nil {
+		t.Fatal(err)
+	}
+	s := testServer(f)
+	const window = "&start=2022-09-01%2000:00:00&end=2022-09-02%2000:00:00"
+
+	response := get(s, "review"+window)
+	var review struct{ Hosts []struct{} }
+	if err := json.Unmarshal(response.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if len(review.Hosts) != 0 {
+		t.Errorf("review shows the subinterface: %s", response.Body)
+	}
+	if response := get(s, "flapchart&host=10.0.0.1"+window); response.Code != http.StatusNotFound {
+		t.Errorf("host overview chart: %d, want %d", response.Code, http.StatusNotFound)
+	}
+
+	response = get(s, "flaphistory&host=10.0.0.1&ifindex=5"+window)
+	var history struct{ Flaps []struct{ Id int } }
+	if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Flaps) != 1 {
+		t.Errorf("flaphistory of the subinterface: %s", response.Body)
+	}
+}